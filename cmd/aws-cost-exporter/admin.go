@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// adminHandler serves endpoints which trigger exporter actions.
+// Authentication is provided by exporter-toolkit web configuration,
+// which wraps every handler of the server.
+type adminHandler struct {
+	exporter controller
+	gatherer *intervalGatherer
+	logger   log.Logger
+}
+
+type adminResponse struct {
+	Status   string `json:"status"`
+	Action   string `json:"action"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (h *adminHandler) register(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix+"/refresh", h.handle("refresh", func(r *http.Request) error {
+		return h.exporter.Refresh(r.Context())
+	}))
+
+	mux.HandleFunc(prefix+"/refetch", h.handle("refetch", func(r *http.Request) error {
+		period, err := state.ParseBillingPeriod(r.FormValue("period"))
+		if err != nil {
+			return err
+		}
+
+		return h.exporter.Refetch(r.Context(), *period)
+	}))
+
+	mux.HandleFunc(prefix+"/recompute", h.handle("recompute", func(r *http.Request) error {
+		return h.exporter.Recompute(r.Context())
+	}))
+}
+
+func (h *adminHandler) handle(action string, fn func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		level.Info(h.logger).Log("msg", "Admin action requested", "action", action, "remote", r.RemoteAddr)
+
+		start := time.Now()
+		err := fn(r)
+		if err == nil {
+			// Make results visible to scrapes without waiting for the next interval
+			err = h.gatherer.update(h.exporter.Metrics())
+		}
+
+		response := adminResponse{
+			Status:   "success",
+			Action:   action,
+			Duration: time.Since(start).String(),
+		}
+		code := http.StatusOK
+
+		if err != nil {
+			level.Error(h.logger).Log("msg", "Admin action failed", "action", action, "err", err)
+
+			response.Status = "error"
+			response.Error = err.Error()
+			code = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/collector"
+	"github.com/st8ed/aws-cost-exporter/pkg/fetcher"
+	"github.com/st8ed/aws-cost-exporter/pkg/processor"
+	"github.com/st8ed/aws-cost-exporter/pkg/sink"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+type exporter struct {
+	ctx      context.Context
+	config   *state.Config
+	state    *state.State
+	client   *s3.Client
+	registry atomic.Pointer[prometheus.Registry]
+	interval time.Duration
+	sinks    []sink.Sink
+	logger   log.Logger
+
+	// Serializes refreshes triggered by the interval
+	// gatherer and by admin endpoints
+	mu sync.Mutex
+}
+
+func newExporter(ctx context.Context, interval time.Duration, config *state.Config, state *state.State, client *s3.Client, sinks []sink.Sink, logger log.Logger) *exporter {
+	return &exporter{
+		ctx:      ctx,
+		config:   config,
+		state:    state,
+		client:   client,
+		interval: interval,
+		sinks:    sinks,
+		logger:   logger,
+	}
+}
+
+// Init lists billing periods, downloads reports which aren't cached yet
+// and computes metrics. It has to succeed before metrics are served
+func (e *exporter) Init(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	periods, err := fetcher.GetBillingPeriods(e.config, e.client, e.logger)
+	if err != nil {
+		return err
+	}
+
+	e.state.Lock()
+	e.state.Periods = periods
+	e.state.Unlock()
+
+	if err := collector.Prefetch(e.state, e.config, e.client, periods, e.logger); err != nil {
+		return err
+	}
+
+	if err := e.save(); err != nil {
+		return err
+	}
+
+	return e.compute(ctx)
+}
+
+// Gather implements prometheus.Gatherer.
+func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
+	if err := e.Refresh(e.ctx); err != nil {
+		return nil, err
+	}
+
+	return e.Metrics().Gather()
+}
+
+// Metrics returns registry with results of the last successful computation.
+func (e *exporter) Metrics() prometheus.Gatherer {
+	return e.registry.Load()
+}
+
+// Refresh checks whether reports of the most recent billing period and of
+// periods which are being finalized by AWS were updated and recomputes
+// metrics if their data changed.
+func (e *exporter) Refresh(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.state.Periods) == 0 {
+		return nil
+	}
+
+	periods := e.state.Periods
+
+	if periods[len(periods)-1].IsPastDue() {
+		var err error
+		if periods, err = fetcher.GetBillingPeriods(e.config, e.client, e.logger); err != nil {
+			return err
+		}
+
+		if len(periods) == 0 {
+			return nil
+		}
+
+		e.state.Lock()
+		e.state.Periods = periods
+		e.state.Unlock()
+	}
+
+	updated, dataChanged := false, false
+
+	for i, period := range periods {
+		if i < len(periods)-1 && !collector.IsFinalizing(e.state, e.config, period) {
+			continue
+		}
+
+		u, d, err := collector.UpdateReport(e.state, e.config, e.client, &period, e.logger)
+		if err != nil {
+			return err
+		}
+
+		updated, dataChanged = updated || u, dataChanged || d
+	}
+
+	// Reports are already downloaded, so metrics are computed
+	// even if state was saved by another instance meanwhile
+	var saveErr error
+	if updated {
+		saveErr = e.save()
+	}
+
+	if dataChanged {
+		if err := e.compute(ctx); err != nil {
+			return err
+		}
+	}
+
+	return saveErr
+}
+
+// Refetch downloads the report of given billing period
+// regardless of cached state and recomputes metrics.
+func (e *exporter) Refetch(ctx context.Context, period state.BillingPeriod) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	known := false
+	for _, p := range e.state.Periods {
+		if p.Start.Equal(period.Start) {
+			known = true
+			break
+		}
+	}
+
+	if !known {
+		return fmt.Errorf("unknown billing period: %s", period)
+	}
+
+	if err := collector.RefetchReport(e.state, e.config, e.client, &period, e.logger); err != nil {
+		return err
+	}
+
+	if err := e.save(); err != nil {
+		return err
+	}
+
+	return e.compute(ctx)
+}
+
+// save stores state unless another instance saved it since it was loaded,
+// then its state is reloaded and the conflict is reported. Reports fetched
+// by this instance are already in the repository, so they aren't downloaded
+// again if the other instance didn't know them
+func (e *exporter) save() error {
+	err := e.state.Save(e.config)
+
+	var conflict *state.ConflictError
+	if errors.As(err, &conflict) {
+		if rerr := e.state.Reload(e.config, e.logger); rerr != nil {
+			return fmt.Errorf("%w, reload failed: %v", err, rerr)
+		}
+	}
+
+	return err
+}
+
+// Recompute reloads and reruns all queries against already fetched reports.
+// If any query fails, metrics of the previous computation are kept.
+func (e *exporter) Recompute(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.compute(ctx)
+}
+
+func (e *exporter) compute(ctx context.Context) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, e.interval)
+	defer cancel()
+
+	registry, err := processor.Compute(ctxWithTimeout, e.state, e.config, e.logger)
+	if err != nil {
+		return err
+	}
+
+	if err := registry.Register(collector.NewPeriodCollector(e.state, e.config)); err != nil {
+		return err
+	}
+
+	e.registry.Store(registry)
+
+	// Failures are logged, metrics are still served
+	sendMetrics(ctxWithTimeout, e.sinks, registry, e.logger)
+
+	return nil
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/user"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -24,8 +26,7 @@ import (
 	"golang.org/x/sync/errgroup"
 	kingpin "github.com/alecthomas/kingpin/v2"
 
-	"github.com/st8ed/aws-cost-exporter/pkg/collector"
-	"github.com/st8ed/aws-cost-exporter/pkg/fetcher"
+	"github.com/st8ed/aws-cost-exporter/pkg/election"
 	"github.com/st8ed/aws-cost-exporter/pkg/processor"
 	"github.com/st8ed/aws-cost-exporter/pkg/state"
 )
@@ -33,6 +34,7 @@ import (
 type intervalGatherer struct {
 	gatherer prometheus.Gatherer
 	cache    atomic.Pointer[[]*dto.MetricFamily]
+	lastRun  atomic.Pointer[time.Time]
 }
 
 // Gather implements prometheus.Gatherer.
@@ -44,16 +46,28 @@ func (ig *intervalGatherer) Gather() ([]*dto.MetricFamily, error) {
 	return *mfs, nil
 }
 
+// update will gather metrics from the given gatherer and replace cached ones.
+func (ig *intervalGatherer) update(gatherer prometheus.Gatherer) error {
+	now := time.Now()
+	ig.lastRun.Store(&now)
+
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	ig.cache.Store(&mfs)
+
+	return nil
+}
+
 // Run will gather metrics from the gatherer at the given interval until the context is done.
 func (ig *intervalGatherer) Run(ctx context.Context, interval time.Duration) error {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
-		mfs, err := ig.gatherer.Gather()
-		if err != nil {
+		if err := ig.update(ig.gatherer); err != nil {
 			return err
 		}
-		ig.cache.Store(&mfs)
 		select {
 		case <-ctx.Done():
 			return nil
@@ -62,83 +76,18 @@ func (ig *intervalGatherer) Run(ctx context.Context, interval time.Duration) err
 	}
 }
 
-func newGatherer(ctx context.Context, interval time.Duration, config *state.Config, state *state.State, client *s3.Client, logger log.Logger) (prometheus.Gatherer, error) {
-	reg := prometheus.NewRegistry()
-
-	periods, err := fetcher.GetBillingPeriods(config, client)
-	if err != nil {
-		return nil, err
-	}
-
-	state.Periods = periods
-
-	if err := collector.Prefetch(state, config, client, reg, periods, logger); err != nil {
-		return nil, err
-	}
-
-	if err := state.Save(config); err != nil {
-		return nil, err
-	}
-
-	ctxWithTimeout, cancel := context.WithTimeout(ctx, interval)
-	defer cancel()
-	if err := processor.Compute(ctxWithTimeout, config, reg, logger); err != nil {
-		return nil, err
-	}
-
-	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, interval)
-		defer cancel()
-		if len(state.Periods) > 0 {
-			period := state.Periods[len(state.Periods)-1]
-
-			if period.IsPastDue() {
-				periods, err := fetcher.GetBillingPeriods(config, client)
-				if err != nil {
-					return nil, err
-				}
-
-				state.Periods = periods
-				period = periods[len(periods)-1]
-			}
-
-			changed, err := collector.UpdateReport(state, config, client, &period, logger)
-			if err != nil {
-				return nil, err
-			}
-
-			if changed {
-				if err := state.Save(config); err != nil {
-					return nil, err
-				}
-
-				if err := processor.Compute(ctxWithTimeout, config, reg, logger); err != nil {
-					return nil, err
-				}
-			}
-		}
-
-		return reg.Gather()
-	}), nil
-}
-
 func main() {
 	var (
-		bucketName = kingpin.Flag(
-			"bucket",
-			"Name of the S3 bucket with detailed billing report(s)",
-		).Required().String()
+		bucketName string
+		reportName string
 
-		interval = kingpin.Flag(
-			"interval",
-			"How long to wait between background computations of the billing report.",
-		).Default("5m").Duration()
+		finalizationGrace time.Duration
 
-		reportName = kingpin.Flag(
-			"report",
-			"Name of the AWS detailed billing report in supplied S3 bucket",
-		).Required().String()
+		sinkFlags  = &sinkFlags{}
+		stateFlags = &stateFlags{}
+	)
 
+	var (
 		repositoryPath = kingpin.Flag(
 			"repository",
 			"Path to store cached AWS billing reports",
@@ -149,33 +98,239 @@ func main() {
 			"Path to directory with SQL queries for gathering metrics",
 		).Default("/etc/aws-cost-exporter/queries").String()
 
+		queryVariables = kingpin.Flag(
+			"query.variable",
+			"Variable available to query templates as {{.Vars.<name>}}, can be repeated: <name>=<value>",
+		).StringMap()
+
+		queryEngine = kingpin.Flag(
+			"query.engine",
+			"SQL engine to run queries with. sqlite imports each report into a database once instead of parsing CSV files on every run. One of: [csvq, sqlite]",
+		).Default(processor.EngineCSVQ).Enum(processor.EngineCSVQ, processor.EngineSQLite)
+
+		queryCache = kingpin.Flag(
+			"query.cache",
+			"Reuse results of queries whose rendered text and referenced reports didn't change since the last run.",
+		).Default("true").Bool()
+
+		rollupFlags = kingpin.Flag(
+			"rollup",
+			"Rollup built once per report and available to queries as rollup-<name>-current.csv, rollup-<name>-1.csv, ..., can be repeated: <name>=<dimension>,... where dimension is a report column or day",
+		).StringMap()
+
 		stateFilePath = kingpin.Flag(
 			"state-path",
 			"Path to store exporter state",
 		).Default("/var/lib/aws-cost-exporter/state.json").String()
+	)
+
+	stateFlags.register(kingpin.CommandLine)
 
-		metricsPath = kingpin.Flag(
+	toolkitFlags := kingpinflag.AddFlags(kingpin.CommandLine, ":9100")
+
+	var (
+		serveCommand = kingpin.Command("serve", "Serve metrics computed from AWS billing reports.").Default()
+
+		interval = serveCommand.Flag(
+			"interval",
+			"How long to wait between background computations of the billing report.",
+		).Default("5m").Duration()
+
+		queriesWatchInterval = serveCommand.Flag(
+			"queries-dir.watch-interval",
+			"How often to check queries directory for changes and reload queries. Zero disables watching, SIGHUP always reloads queries.",
+		).Default("0s").Duration()
+
+		metricsPath = serveCommand.Flag(
 			"web.telemetry-path",
 			"Path under which to expose metrics.",
 		).Default("/metrics").String()
 
-		disableExporterMetrics = kingpin.Flag(
+		disableExporterMetrics = serveCommand.Flag(
 			"web.disable-exporter-metrics",
 			"Exclude metrics about the exporter itself (promhttp_*, process_*, go_*).",
 		).Bool()
 
-		toolkitFlags = kingpinflag.AddFlags(kingpin.CommandLine, ":9100")
+		enableAdminAPI = serveCommand.Flag(
+			"web.enable-admin-api",
+			"Enable POST endpoints under /api/v1/admin to trigger refresh, refetch and recompute.",
+		).Bool()
+
+		haElection = serveCommand.Flag(
+			"ha.election",
+			"How replicas elect the leader, which downloads reports and computes metrics served by all of them. One of: [none, kubernetes, file]",
+		).Default("none").Enum("none", "kubernetes", "file")
+
+		haIdentity = serveCommand.Flag(
+			"ha.identity",
+			"Identity of this replica in leader election, hostname if empty.",
+		).String()
+
+		haAdvertiseURL = serveCommand.Flag(
+			"ha.advertise-url",
+			"URL other replicas fetch metrics from while this replica is the leader, http://<hostname>:<listen port> if empty.",
+		).String()
+
+		haClientConfigFile = serveCommand.Flag(
+			"ha.client-config-file",
+			"Path to YAML file with HTTP client settings (basic_auth, authorization, tls_config) used to fetch metrics from the leader, needed if --web.config.file enables TLS or authentication.",
+		).String()
+
+		haLeaseName = serveCommand.Flag(
+			"ha.lease-name",
+			"Name of Kubernetes Lease used for leader election.",
+		).Default("aws-cost-exporter").String()
+
+		haLeaseNamespace = serveCommand.Flag(
+			"ha.lease-namespace",
+			"Namespace of Kubernetes Lease, namespace of the pod if empty.",
+		).String()
+
+		haLeaseDuration = serveCommand.Flag(
+			"ha.lease-duration",
+			"How long leadership is kept without renewal before another replica takes it over.",
+		).Default("15s").Duration()
+
+		haLockFile = serveCommand.Flag(
+			"ha.lock-file",
+			"Path to lock file on storage shared by replicas used for leader election with file election.",
+		).Default("/var/lib/aws-cost-exporter/leader.lock").String()
+
+		runOnceCommand = kingpin.Command("run-once", "Fetch reports, compute metrics once and write them to a file for node_exporter textfile collector.")
+
+		runOnceOutput = runOnceCommand.Flag(
+			"output",
+			"Path to .prom file to write metrics to, it is replaced atomically. Nothing is written if empty.",
+		).String()
+
+		runOnceTimeout = runOnceCommand.Flag(
+			"timeout",
+			"How long to wait for computation of the billing report.",
+		).Default("1h").Duration()
+
+		queryCommand = kingpin.Command("query", "Run a query against locally cached reports and print its result.")
+
+		queryFile = queryCommand.Arg(
+			"file",
+			"Path to file with SQL query",
+		).String()
+
+		queryInline = queryCommand.Flag(
+			"sql",
+			"SQL query to run instead of query file",
+		).Short('e').String()
+
+		queryFormat = queryCommand.Flag(
+			"format",
+			"Output format, table also prints exported metrics. One of: [table, csv, json, metrics]",
+		).Default("table").Enum("table", "csv", "json", "metrics")
+
+		validateCommand = kingpin.Command("validate", "Validate queries and configuration against a sample report.")
+
+		validateSample = validateCommand.Flag(
+			"sample",
+			"Path to uncompressed CSV report to validate queries against instead of bundled synthetic one",
+		).ExistingFile()
+
+		stateCommand = kingpin.Command("state", "Inspect and maintain exporter state.")
+
+		stateShowCommand = stateCommand.Command("show", "Print exporter state migrated to the current version.")
+
+		stateMigrateCommand = stateCommand.Command("migrate", "Upgrade state file to the current version, keeping the previous one as backup.")
 	)
 
+	for _, cmd := range []*kingpin.CmdClause{serveCommand, runOnceCommand} {
+		cmd.Flag(
+			"bucket",
+			"Name of the S3 bucket with detailed billing report(s)",
+		).Required().StringVar(&bucketName)
+
+		cmd.Flag(
+			"report",
+			"Name of the AWS detailed billing report in supplied S3 bucket",
+		).Required().StringVar(&reportName)
+
+		cmd.Flag(
+			"report.finalization-grace",
+			"How long after the end of a billing period its report is still checked for updates, until AWS issues the invoice.",
+		).Default("168h").DurationVar(&finalizationGrace)
+
+		sinkFlags.register(cmd)
+	}
+
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.Version(version.Print("aws-cost-exporter"))
 	kingpin.CommandLine.UsageWriter(os.Stdout)
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	logger := promlog.New(promlogConfig)
 
+	rollups, err := parseRollups(*rollupFlags)
+	if err != nil {
+		level.Error(logger).Log("err", err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case queryCommand.FullCommand():
+		config := &state.Config{
+			RepositoryPath: *repositoryPath,
+			QueriesPath:    *queriesPath,
+			QueryVariables: *queryVariables,
+			QueryEngine:    *queryEngine,
+			Rollups:        rollups,
+		}
+
+		if err := runQueryCommand(config, *queryFile, *queryInline, *queryFormat, os.Stdout, logger); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		return
+
+	case validateCommand.FullCommand():
+		config := &state.Config{
+			QueriesPath:    *queriesPath,
+			QueryVariables: *queryVariables,
+			QueryEngine:    *queryEngine,
+			Rollups:        rollups,
+		}
+
+		if err := runValidateCommand(config, *validateSample, *toolkitFlags.WebConfigFile, os.Stdout, logger); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		return
+
+	case stateShowCommand.FullCommand(), stateMigrateCommand.FullCommand():
+		backend, err := stateFlags.build()
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		config := &state.Config{
+			StateFilePath: *stateFilePath,
+			StateBackend:  backend,
+		}
+
+		if command == stateShowCommand.FullCommand() {
+			err = runStateShowCommand(config, os.Stdout, logger)
+		} else {
+			err = runStateMigrateCommand(config, os.Stdout)
+		}
+
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	level.Info(logger).Log("msg", "Starting aws-cost-exporter", "version", version.Info())
 	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
 	if user, err := user.Current(); err == nil && user.Uid == "0" {
@@ -190,33 +345,116 @@ func main() {
 
 	client := s3.NewFromConfig(cfg)
 
+	stateBackend, err := stateFlags.build()
+	if err != nil {
+		level.Error(logger).Log("err", err)
+		os.Exit(1)
+	}
+
 	config := &state.Config{
 		RepositoryPath: *repositoryPath,
 		QueriesPath:    *queriesPath,
+		QueryVariables: *queryVariables,
+		QueryEngine:    *queryEngine,
+		QueryCache:     *queryCache,
+		Rollups:        rollups,
 		StateFilePath:  *stateFilePath,
+		StateBackend:   stateBackend,
+
+		FinalizationGrace: finalizationGrace,
 
-		BucketName: *bucketName,
-		ReportName: *reportName,
+		BucketName: bucketName,
+		ReportName: reportName,
 	}
 
-	state, err := state.Load(config)
+	state, err := state.Load(config, logger)
 	if err != nil {
 		level.Error(logger).Log("err", err)
 		os.Exit(1)
 	}
 
-	g, ctx := errgroup.WithContext(context.Background())
-
-	gatherer, err := newGatherer(ctx, *interval, config, state, client, logger)
+	sinks, err := sinkFlags.build(config)
 	if err != nil {
 		level.Error(logger).Log("err", err)
 		os.Exit(1)
 	}
 
-	gatherer = &intervalGatherer{
+	if command == runOnceCommand.FullCommand() {
+		if err := runOnce(context.Background(), *runOnceTimeout, config, state, client, sinks, *runOnceOutput, logger); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	g, ctx := errgroup.WithContext(context.Background())
+
+	exporter := newExporter(ctx, *interval, config, state, client, sinks, logger)
+
+	var (
+		ctl      controller          = exporter
+		gatherer prometheus.Gatherer = exporter
+		ha       *replica
+	)
+
+	if *haElection == "none" {
+		if err := exporter.Init(ctx); err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	} else {
+		self, err := replicaIdentity(*haIdentity, *haAdvertiseURL, *toolkitFlags.WebListenAddresses)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		var elector election.Elector
+		if *haElection == "kubernetes" {
+			elector, err = election.NewLease(*haLeaseNamespace, *haLeaseName, *haLeaseDuration, self)
+		} else {
+			elector, err = election.NewFileLock(*haLockFile, self)
+		}
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		level.Info(logger).Log("msg", "Leader election is enabled", "elector", elector.Name(), "identity", self.Identity, "url", self.URL)
+
+		client, err := replicaClient(*haClientConfigFile)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		ha = newReplica(ctx, exporter, config, elector, self, *haLeaseDuration, client, logger)
+		ctl, gatherer = ha, ha
+	}
+
+	ig := &intervalGatherer{
 		gatherer: gatherer,
 	}
-	gatherers := prometheus.Gatherers{gatherer}
+	gatherers := prometheus.Gatherers{ig}
+	if ha != nil {
+		// Serve metrics of this replica as soon as it becomes the leader
+		ha.activated = func() {
+			if err := ig.update(ha.Metrics()); err != nil {
+				level.Error(logger).Log("msg", "Unable to gather metrics after becoming the leader", "err", err)
+			}
+		}
+
+		ha.campaign(ctx)
+
+		g.Go(func() error {
+			return ha.Run(ctx)
+		})
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(ha.leaderGauge)
+		gatherers = append(gatherers, reg)
+	}
 	if !*disableExporterMetrics {
 		reg := prometheus.NewRegistry()
 		reg.MustRegister(collectors.NewBuildInfoCollector())
@@ -227,7 +465,18 @@ func main() {
 	}
 
 	g.Go(func() error {
-		return gatherer.(*intervalGatherer).Run(ctx, *interval)
+		return ig.Run(ctx, *interval)
+	})
+
+	reloader := &queriesReloader{
+		config:   config,
+		exporter: ctl,
+		gatherer: ig,
+		interval: *queriesWatchInterval,
+		logger:   logger,
+	}
+	g.Go(func() error {
+		return reloader.Run(ctx)
 	})
 
 	http.Handle(*metricsPath, promhttp.HandlerFor(
@@ -236,12 +485,31 @@ func main() {
 			EnableOpenMetrics: true,
 		},
 	))
+	http.Handle("/status", &statusHandler{
+		config:   config,
+		state:    state,
+		gatherer: ig,
+		interval: *interval,
+		logger:   logger,
+	})
+	if ha != nil {
+		http.Handle(snapshotPath, promhttp.HandlerFor(ha.Snapshot(), promhttp.HandlerOpts{}))
+	}
+	if *enableAdminAPI {
+		admin := &adminHandler{
+			exporter: ctl,
+			gatherer: ig,
+			logger:   logger,
+		}
+		admin.register(http.DefaultServeMux, "/api/v1/admin")
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>AWS Cost Exporter</title></head>
 			<body>
 			<h1>AWS Cost Exporter</h1>
 			<p><a href="` + *metricsPath + `">Metrics</a></p>
+			<p><a href="/status">Status</a></p>
 			</body>
 			</html>`))
 	})
@@ -267,3 +535,54 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// replicaIdentity fills identity and URL of this replica
+// in leader election from hostname if they are not set
+func replicaIdentity(identity string, url string, listenAddresses []string) (election.Leader, error) {
+	hostname, err := os.Hostname()
+	if err != nil && (identity == "" || url == "") {
+		return election.Leader{}, err
+	}
+
+	if identity == "" {
+		identity = hostname
+	}
+
+	if url == "" {
+		if len(listenAddresses) == 0 {
+			return election.Leader{}, errors.New("unable to determine URL of the replica, set --ha.advertise-url")
+		}
+
+		_, port, err := net.SplitHostPort(listenAddresses[0])
+		if err != nil {
+			return election.Leader{}, err
+		}
+
+		url = "http://" + net.JoinHostPort(hostname, port)
+	}
+
+	return election.Leader{
+		Identity: identity,
+		URL:      strings.TrimSuffix(url, "/"),
+	}, nil
+}
+
+// parseRollups converts --rollup flags to rollup dimensions by name
+func parseRollups(flags map[string]string) (map[string][]string, error) {
+	rollups := make(map[string][]string, len(flags))
+
+	for name, value := range flags {
+		dimensions := strings.Split(value, ",")
+		for i := range dimensions {
+			dimensions[i] = strings.TrimSpace(dimensions[i])
+		}
+
+		if err := processor.ValidateRollup(name, dimensions); err != nil {
+			return nil, err
+		}
+
+		rollups[name] = dimensions
+	}
+
+	return rollups, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/sink"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// runOnce performs full refresh of billing reports and metrics, then sends
+// metrics to sinks and writes them in text format to the output file
+func runOnce(ctx context.Context, timeout time.Duration, config *state.Config, state *state.State, client *s3.Client, sinks []sink.Sink, output string, logger log.Logger) error {
+	exporter := newExporter(ctx, timeout, config, state, client, nil, logger)
+	if err := exporter.Init(ctx); err != nil {
+		return err
+	}
+
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := sendMetrics(ctxWithTimeout, sinks, exporter.Metrics(), logger); err != nil {
+		return err
+	}
+
+	if output == "" {
+		return nil
+	}
+
+	lastSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "aws_cost_exporter_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful run of aws-cost-exporter.",
+	})
+	lastSuccess.SetToCurrentTime()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(lastSuccess)
+
+	if err := writeTextfile(output, prometheus.Gatherers{exporter.Metrics(), reg}); err != nil {
+		return err
+	}
+
+	level.Info(logger).Log("msg", "Metrics written", "file", output)
+
+	return nil
+}
+
+// writeTextfile atomically replaces the file with metrics, so textfile
+// collector never reads partially written file. Timestamps are dropped
+// since the collector rejects files with them
+func writeTextfile(path string, gatherer prometheus.Gatherer) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := writeMetrics(f, sink.WithoutTimestamps(gatherer)); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
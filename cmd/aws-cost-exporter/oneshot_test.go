@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(f, ch)
+}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
+func TestWriteTextfile(t *testing.T) {
+	desc := prometheus.NewDesc("aws_cost", "Cost.", []string{"day"}, nil)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.NewMetricWithTimestamp(
+			time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "2023-10-01"),
+		)
+	}))
+
+	path := filepath.Join(t.TempDir(), "aws_cost.prom")
+	if err := writeTextfile(path, registry); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "# HELP aws_cost Cost.\n# TYPE aws_cost gauge\naws_cost{day=\"2023-10-01\"} 1\n"
+	if string(data) != expected {
+		t.Errorf("textfile contains %q, expected %q", data, expected)
+	}
+
+	if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) != 0 {
+		t.Errorf("temporary files %v are left", matches)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/processor"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// runQueryCommand runs a single query against the local repository
+// and prints its result, no AWS access is required
+func runQueryCommand(config *state.Config, file string, inline string, format string, w io.Writer, logger log.Logger) error {
+	var query processor.Query
+
+	switch {
+	case inline != "" && file != "":
+		return fmt.Errorf("either query file or --sql must be specified, not both")
+
+	case inline != "":
+		query = processor.Query{Name: "<inline>", Text: inline}
+
+	case file != "":
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		query = processor.Query{Name: filepath.Base(file), Text: string(text)}
+
+	default:
+		return fmt.Errorf("query file or --sql must be specified")
+	}
+
+	db, err := processor.Open(config, logger)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			level.Warn(logger).Log("msg", "Unable to close database", "err", err)
+		}
+	}()
+
+	// Raw columns of reports aren't valid label names, so the result
+	// is printed even if it can't be exported as metrics
+	table, registry, err := processor.Execute(context.Background(), db, config, query, logger)
+
+	var metricsErr *processor.MetricsError
+	if errors.As(err, &metricsErr) && format != "metrics" {
+		level.Warn(logger).Log("msg", "Query result can't be exported as metrics", "query", query.Name, "err", metricsErr.Err)
+	} else if err != nil {
+		return fmt.Errorf("query %s: %w", query.Name, err)
+	}
+
+	switch format {
+	case "table":
+		if err := writeTable(w, table); err != nil {
+			return err
+		}
+
+		if registry == nil {
+			return nil
+		}
+
+		fmt.Fprintln(w)
+
+		return writeMetrics(w, registry)
+
+	case "csv":
+		return writeCSV(w, table)
+
+	case "json":
+		return writeJSON(w, table)
+
+	case "metrics":
+		return writeMetrics(w, registry)
+
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+func writeTable(w io.Writer, table *processor.Table) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	for i, column := range table.Columns {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, column)
+	}
+	fmt.Fprintln(tw)
+
+	for _, row := range table.Rows {
+		for i, value := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, formatValue(value))
+		}
+		fmt.Fprintln(tw)
+	}
+
+	fmt.Fprintf(tw, "(%d rows)\n", len(table.Rows))
+
+	return tw.Flush()
+}
+
+func writeCSV(w io.Writer, table *processor.Table) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(table.Columns); err != nil {
+		return err
+	}
+
+	for _, row := range table.Rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = formatValue(value)
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeJSON(w io.Writer, table *processor.Table) error {
+	records := make([]map[string]interface{}, len(table.Rows))
+
+	for i, row := range table.Rows {
+		records[i] = make(map[string]interface{}, len(row))
+		for j, value := range row {
+			records[i][table.Columns[j]] = value
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+
+	return encoder.Encode(records)
+}
+
+func writeMetrics(w io.Writer, gatherer prometheus.Gatherer) error {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
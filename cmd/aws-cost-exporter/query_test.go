@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+const testReport = `identity/LineItemId,lineItem/ProductCode,lineItem/UnblendedCost
+a,AmazonEC2,0.5
+b,AmazonS3,1.25
+`
+
+func TestRunQueryCommandRawColumns(t *testing.T) {
+	repository := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repository, "data"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repository, "data", "20231001-test.csv"), []byte(testReport), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &state.Config{RepositoryPath: repository}
+	query := "select `lineItem/ProductCode`, `lineItem/UnblendedCost` from `report-current.csv` order by `lineItem/ProductCode`"
+
+	cases := []struct {
+		format string
+		output string
+		err    bool
+	}{
+		{"csv", "lineItem/ProductCode,lineItem/UnblendedCost\nAmazonEC2,0.5\nAmazonS3,1.25\n", false},
+		{"metrics", "", true},
+	}
+
+	for _, c := range cases {
+		var output bytes.Buffer
+
+		err := runQueryCommand(config, "", query, c.format, &output, log.NewNopLogger())
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: runQueryCommand() succeeded, expected error", c.format)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", c.format, err)
+			continue
+		}
+
+		if output.String() != c.output {
+			t.Errorf("%s: output %q, expected %q", c.format, output.String(), c.output)
+		}
+	}
+}
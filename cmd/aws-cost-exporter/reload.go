@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/processor"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// queriesReloader recomputes metrics when SIGHUP is received or,
+// if watch interval is set, when contents of queries directory change
+type queriesReloader struct {
+	config   *state.Config
+	exporter controller
+	gatherer *intervalGatherer
+	interval time.Duration
+	logger   log.Logger
+}
+
+func (r *queriesReloader) Run(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	digest := r.digest()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-hup:
+			level.Info(r.logger).Log("msg", "Received SIGHUP, reloading queries")
+
+		case <-tick:
+			d := r.digest()
+			if d == "" || d == digest {
+				continue
+			}
+
+			level.Info(r.logger).Log("msg", "Queries directory changed, reloading queries")
+		}
+
+		digest = r.digest()
+
+		if err := r.exporter.Recompute(ctx); errors.Is(err, errNotLeader) {
+			level.Info(r.logger).Log("msg", "Queries are reloaded by the leader replica")
+			continue
+		} else if err != nil {
+			level.Error(r.logger).Log("msg", "Failed to reload queries, keeping previous metrics", "err", err)
+			continue
+		}
+
+		if err := r.gatherer.update(r.exporter.Metrics()); err != nil {
+			return err
+		}
+
+		level.Info(r.logger).Log("msg", "Queries reloaded")
+	}
+}
+
+// Returns digest of queries directory or empty string on errors,
+// which are reported once queries are actually reloaded
+func (r *queriesReloader) digest() string {
+	queries, err := processor.LoadQueries(r.config)
+	if err != nil {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, query := range queries {
+		h.Write([]byte(query.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(query.Text))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
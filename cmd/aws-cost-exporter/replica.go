@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/election"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Endpoint serving metrics computed by the leader to other replicas
+const snapshotPath = "/api/v1/snapshot"
+
+// controller triggers actions of the exporter from admin
+// endpoints and queries reloader
+type controller interface {
+	Refresh(ctx context.Context) error
+	Refetch(ctx context.Context, period state.BillingPeriod) error
+	Recompute(ctx context.Context) error
+	Metrics() prometheus.Gatherer
+}
+
+// replica runs the exporter only while it is the leader among replicas,
+// so reports are downloaded and state is written by one of them.
+// Followers serve snapshot of metrics fetched from the leader
+type replica struct {
+	ctx      context.Context
+	exporter *exporter
+	config   *state.Config
+	elector  election.Elector
+	self     election.Leader
+	duration time.Duration
+	client   *http.Client
+	logger   log.Logger
+
+	isLeader atomic.Bool
+	leader   atomic.Pointer[election.Leader]
+	snapshot atomic.Pointer[[]*dto.MetricFamily]
+
+	// Whether the exporter was initialized since the replica became the leader
+	active atomic.Bool
+	// Whether the exporter is being initialized in background
+	activating atomic.Bool
+	// Called once the exporter is initialized, if set
+	activated func()
+
+	leaderGauge prometheus.Gauge
+
+	// When leadership was renewed last, accessed only by campaigns
+	renewed time.Time
+
+	// Serializes gathering and actions of the exporter
+	mu sync.Mutex
+}
+
+var errNotLeader = errors.New("this replica is not the leader")
+
+func newReplica(ctx context.Context, exporter *exporter, config *state.Config, elector election.Elector, self election.Leader, duration time.Duration, client *http.Client, logger log.Logger) *replica {
+	return &replica{
+		ctx:      ctx,
+		exporter: exporter,
+		config:   config,
+		elector:  elector,
+		self:     self,
+		duration: duration,
+		client:   client,
+		logger:   logger,
+
+		leaderGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "aws_cost_exporter_leader",
+			Help: "Whether this replica is the leader, which downloads reports and computes metrics served by all replicas.",
+		}),
+	}
+}
+
+// replicaClient returns client fetching metrics from the leader with
+// settings from the file, which match --web.config.file of replicas
+func replicaClient(configFile string) (*http.Client, error) {
+	if configFile == "" {
+		return &http.Client{Timeout: 30 * time.Second}, nil
+	}
+
+	config, _, err := commonconfig.LoadHTTPConfigFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %w", configFile, err)
+	}
+
+	client, err := commonconfig.NewClientFromConfig(*config, "aws-cost-exporter")
+	if err != nil {
+		return nil, err
+	}
+
+	client.Timeout = 30 * time.Second
+
+	return client, nil
+}
+
+// Run campaigns for leadership until the context is done,
+// then resigns so another replica takes over right away
+func (r *replica) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			resignCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := r.elector.Resign(resignCtx); err != nil {
+				level.Warn(r.logger).Log("msg", "Unable to resign leadership", "elector", r.elector.Name(), "err", err)
+			}
+
+			return nil
+		case <-ticker.C:
+		}
+
+		r.campaign(ctx)
+	}
+}
+
+func (r *replica) campaign(ctx context.Context) {
+	leader, err := r.elector.Campaign(ctx)
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "Leader election failed", "elector", r.elector.Name(), "err", err)
+
+		// Leadership can't be renewed, so another replica
+		// may take it over once it expires
+		if r.isLeader.Load() && time.Since(r.renewed) > r.duration {
+			r.setLeader(nil)
+		}
+
+		return
+	}
+
+	if leader != nil && leader.Identity == r.self.Identity {
+		r.renewed = time.Now()
+	}
+
+	r.setLeader(leader)
+}
+
+func (r *replica) setLeader(leader *election.Leader) {
+	isLeader := leader != nil && leader.Identity == r.self.Identity
+
+	if r.isLeader.Swap(isLeader) != isLeader {
+		if isLeader {
+			level.Info(r.logger).Log("msg", "Became the leader", "elector", r.elector.Name())
+			r.activate()
+		} else {
+			level.Info(r.logger).Log("msg", "Lost leadership", "elector", r.elector.Name())
+		}
+	}
+
+	if isLeader {
+		r.leaderGauge.Set(1)
+	} else {
+		r.leaderGauge.Set(0)
+	}
+
+	r.leader.Store(leader)
+}
+
+// activate initializes the exporter in background once the replica becomes
+// the leader, so it doesn't wait for the next interval. Failures are retried
+// until it succeeds or leadership is lost, followers keep serving metrics
+// of the previous leader meanwhile
+func (r *replica) activate() {
+	if !r.activating.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer r.activating.Store(false)
+
+		for r.isLeader.Load() && !r.active.Load() {
+			err := r.init()
+			if err == nil {
+				if r.activated != nil && r.active.Load() {
+					r.activated()
+				}
+
+				return
+			}
+
+			level.Error(r.logger).Log("msg", "Unable to start the exporter after becoming the leader, retrying", "retry_in", r.duration, "err", err)
+
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(r.duration):
+			}
+		}
+	}()
+}
+
+func (r *replica) init() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.isLeader.Load() || r.active.Load() {
+		return nil
+	}
+
+	// The previous leader may have saved state since it was loaded
+	if err := r.exporter.state.Reload(r.config, r.logger); err != nil {
+		return err
+	}
+
+	if err := r.exporter.Init(r.ctx); err != nil {
+		return err
+	}
+
+	r.active.Store(r.isLeader.Load())
+
+	return nil
+}
+
+// Gather implements prometheus.Gatherer.
+func (r *replica) Gather() ([]*dto.MetricFamily, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.isLeader.Load() {
+		r.active.Store(false)
+
+		if err := r.fetchSnapshot(); err != nil {
+			level.Warn(r.logger).Log("msg", "Unable to fetch metrics from the leader, serving previous ones", "err", err)
+		}
+
+		return r.snapshotGatherer().Gather()
+	}
+
+	// Until the exporter is initialized, metrics
+	// of the previous leader are served
+	if !r.active.Load() {
+		r.activate()
+
+		return r.snapshotGatherer().Gather()
+	}
+
+	return r.exporter.Gather()
+}
+
+// Metrics returns metrics of the exporter while the replica is the leader,
+// otherwise the snapshot fetched from the leader last
+func (r *replica) Metrics() prometheus.Gatherer {
+	if r.active.Load() {
+		return r.exporter.Metrics()
+	}
+
+	return r.snapshotGatherer()
+}
+
+func (r *replica) snapshotGatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs := r.snapshot.Load()
+		if mfs == nil {
+			return nil, nil
+		}
+
+		return *mfs, nil
+	})
+}
+
+func (r *replica) fetchSnapshot() error {
+	leader := r.leader.Load()
+	if leader == nil || leader.URL == "" {
+		return errors.New("leader is unknown")
+	}
+
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, leader.URL+snapshotPath, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", string(expfmt.FmtProtoDelim))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader %s responded with status %s", leader.Identity, resp.Status)
+	}
+
+	decoder := expfmt.NewDecoder(resp.Body, expfmt.ResponseFormat(resp.Header))
+	mfs := make([]*dto.MetricFamily, 0)
+
+	for {
+		mf := &dto.MetricFamily{}
+		if err := decoder.Decode(mf); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		mfs = append(mfs, mf)
+	}
+
+	r.snapshot.Store(&mfs)
+
+	return nil
+}
+
+// Snapshot serves metrics computed by this replica while it is the leader
+func (r *replica) Snapshot() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if !r.active.Load() {
+			return nil, errNotLeader
+		}
+
+		return r.exporter.Metrics().Gather()
+	})
+}
+
+func (r *replica) Refresh(ctx context.Context) error {
+	return r.whileLeader(func() error { return r.exporter.Refresh(ctx) })
+}
+
+func (r *replica) Refetch(ctx context.Context, period state.BillingPeriod) error {
+	return r.whileLeader(func() error { return r.exporter.Refetch(ctx, period) })
+}
+
+func (r *replica) Recompute(ctx context.Context) error {
+	return r.whileLeader(func() error { return r.exporter.Recompute(ctx) })
+}
+
+func (r *replica) whileLeader(fn func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.isLeader.Load() || !r.active.Load() {
+		if leader := r.leader.Load(); leader != nil {
+			return fmt.Errorf("%w, the leader is %s", errNotLeader, leader.Identity)
+		}
+
+		return errNotLeader
+	}
+
+	return fn()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/election"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Reports a fixed leader
+type staticElector struct {
+	leader *election.Leader
+}
+
+func (e *staticElector) Name() string {
+	return "static"
+}
+
+func (e *staticElector) Campaign(ctx context.Context) (*election.Leader, error) {
+	return e.leader, nil
+}
+
+func (e *staticElector) Resign(ctx context.Context) error {
+	return nil
+}
+
+// Returns replica with exporter serving the cost gauge
+func newTestReplica(t *testing.T, self election.Leader, elector election.Elector, cost float64) *replica {
+	t.Helper()
+
+	ctx := context.Background()
+	config := &state.Config{}
+
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "aws_cost", Help: "Cost."})
+	gauge.Set(cost)
+	registry.MustRegister(gauge)
+
+	e := newExporter(ctx, 0, config, state.Init(), nil, nil, log.NewNopLogger())
+	e.registry.Store(registry)
+
+	return newReplica(ctx, e, config, elector, self, 0, http.DefaultClient, log.NewNopLogger())
+}
+
+func gatheredCost(t *testing.T, gatherer prometheus.Gatherer) float64 {
+	t.Helper()
+
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		if mf.GetName() == "aws_cost" {
+			return mf.Metric[0].GetGauge().GetValue()
+		}
+	}
+
+	t.Fatalf("gathered %v, expected aws_cost", mfs)
+	return 0
+}
+
+func TestReplicaGather(t *testing.T) {
+	self := election.Leader{Identity: "leader"}
+	leader := newTestReplica(t, self, &staticElector{&self}, 1)
+
+	// Initialization of the exporter is skipped
+	leader.isLeader.Store(true)
+	leader.active.Store(true)
+	leader.leader.Store(&self)
+
+	mux := http.NewServeMux()
+	mux.Handle(snapshotPath, promhttp.HandlerFor(leader.Snapshot(), promhttp.HandlerOpts{}))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	self.URL = server.URL
+
+	follower := newTestReplica(t, election.Leader{Identity: "follower"}, &staticElector{&self}, 2)
+	follower.campaign(context.Background())
+
+	if follower.isLeader.Load() {
+		t.Fatal("follower became the leader")
+	}
+
+	if cost := gatheredCost(t, leader); cost != 1 {
+		t.Errorf("leader gathered cost %v, expected its own 1", cost)
+	}
+
+	if cost := gatheredCost(t, follower); cost != 1 {
+		t.Errorf("follower gathered cost %v, expected 1 of the leader", cost)
+	}
+
+	// The leader stops serving snapshot once it loses leadership,
+	// followers keep metrics they fetched last
+	leader.active.Store(false)
+
+	if cost := gatheredCost(t, follower); cost != 1 {
+		t.Errorf("follower gathered cost %v after leader stepped down, expected previous 1", cost)
+	}
+
+	if err := follower.Refresh(context.Background()); !errors.Is(err, errNotLeader) {
+		t.Errorf("follower Refresh() = %v, expected %v", err, errNotLeader)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/sink"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// sinkFlags are shared by commands which compute metrics
+type sinkFlags struct {
+	pushURL          string
+	pushJob          string
+	pushGrouping     map[string]string
+	pushUsername     string
+	pushPasswordFile string
+
+	remoteWriteURL             string
+	remoteWriteTimeout         time.Duration
+	remoteWriteUsername        string
+	remoteWritePasswordFile    string
+	remoteWriteBearerTokenFile string
+	remoteWriteTimestampLabel  string
+
+	otlpEndpoint           string
+	otlpProtocol           string
+	otlpTimeout            time.Duration
+	otlpHeaders            map[string]string
+	otlpResourceAttributes map[string]string
+}
+
+func (f *sinkFlags) register(cmd *kingpin.CmdClause) {
+	cmd.Flag(
+		"push.url",
+		"URL of Prometheus Pushgateway to push metrics to after each computation. Pushing is disabled if empty.",
+	).StringVar(&f.pushURL)
+
+	cmd.Flag(
+		"push.job",
+		"Job name of metrics pushed to Pushgateway.",
+	).Default("aws-cost-exporter").StringVar(&f.pushJob)
+
+	cmd.Flag(
+		"push.grouping",
+		"Grouping label of metrics pushed to Pushgateway, e.g. report=my-report. Repeatable.",
+	).PlaceHolder("NAME=VALUE").StringMapVar(&f.pushGrouping)
+
+	cmd.Flag(
+		"push.username",
+		"Username for basic authentication on Pushgateway.",
+	).StringVar(&f.pushUsername)
+
+	cmd.Flag(
+		"push.password-file",
+		"Path to file with password for basic authentication on Pushgateway.",
+	).StringVar(&f.pushPasswordFile)
+
+	cmd.Flag(
+		"remote-write.url",
+		"URL of Prometheus remote write endpoint to write metrics to after each computation. Writing is disabled if empty.",
+	).StringVar(&f.remoteWriteURL)
+
+	cmd.Flag(
+		"remote-write.timeout",
+		"Timeout of a single remote write request.",
+	).Default("30s").DurationVar(&f.remoteWriteTimeout)
+
+	cmd.Flag(
+		"remote-write.username",
+		"Username for basic authentication on remote write endpoint.",
+	).StringVar(&f.remoteWriteUsername)
+
+	cmd.Flag(
+		"remote-write.password-file",
+		"Path to file with password for basic authentication on remote write endpoint.",
+	).StringVar(&f.remoteWritePasswordFile)
+
+	cmd.Flag(
+		"remote-write.bearer-token-file",
+		"Path to file with bearer token for remote write endpoint.",
+	).StringVar(&f.remoteWriteBearerTokenFile)
+
+	cmd.Flag(
+		"remote-write.timestamp-label",
+		"Label of exported metrics which holds sample timestamp for remote write, e.g. selected from lineItem/UsageStartDate. The label itself is not written. Timestamps are taken from timestamp_ column if empty.",
+	).StringVar(&f.remoteWriteTimestampLabel)
+
+	cmd.Flag(
+		"otlp.endpoint",
+		"URL of OpenTelemetry collector OTLP endpoint to export metrics to after each computation, e.g. http://collector:4318, or http://collector:4317 with gRPC. Exporting is disabled if empty.",
+	).StringVar(&f.otlpEndpoint)
+
+	cmd.Flag(
+		"otlp.protocol",
+		"Transport protocol of OTLP, gRPC uses plaintext with http endpoint and TLS with https endpoint. One of: [http/protobuf, grpc]",
+	).Default(sink.OTLPProtocolHTTP).EnumVar(&f.otlpProtocol, sink.OTLPProtocolHTTP, sink.OTLPProtocolGRPC)
+
+	cmd.Flag(
+		"otlp.timeout",
+		"Timeout of a single OTLP export request.",
+	).Default("30s").DurationVar(&f.otlpTimeout)
+
+	cmd.Flag(
+		"otlp.header",
+		"Header sent with OTLP export requests, e.g. Authorization=Bearer TOKEN. Repeatable.",
+	).PlaceHolder("NAME=VALUE").StringMapVar(&f.otlpHeaders)
+
+	cmd.Flag(
+		"otlp.resource-attribute",
+		"Resource attribute of exported metrics, e.g. cloud.account.id=123456789012. Repeatable, overrides defaults.",
+	).PlaceHolder("NAME=VALUE").StringMapVar(&f.otlpResourceAttributes)
+}
+
+func (f *sinkFlags) build(config *state.Config) ([]sink.Sink, error) {
+	sinks := make([]sink.Sink, 0)
+
+	if f.pushURL != "" {
+		s, err := sink.NewPushgateway(sink.PushgatewayConfig{
+			URL:          f.pushURL,
+			Job:          f.pushJob,
+			Grouping:     f.pushGrouping,
+			Username:     f.pushUsername,
+			PasswordFile: f.pushPasswordFile,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, s)
+	}
+
+	if f.remoteWriteURL != "" {
+		s, err := sink.NewRemoteWrite(sink.RemoteWriteConfig{
+			URL:             f.remoteWriteURL,
+			Timeout:         f.remoteWriteTimeout,
+			Username:        f.remoteWriteUsername,
+			PasswordFile:    f.remoteWritePasswordFile,
+			BearerTokenFile: f.remoteWriteBearerTokenFile,
+			TimestampLabel:  f.remoteWriteTimestampLabel,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, s)
+	}
+
+	if f.otlpEndpoint != "" {
+		attributes := map[string]string{
+			"service.name":   "aws-cost-exporter",
+			"aws.s3.bucket":  config.BucketName,
+			"aws.cur.report": config.ReportName,
+		}
+
+		for name, value := range f.otlpResourceAttributes {
+			attributes[name] = value
+		}
+
+		s, err := sink.NewOTLP(sink.OTLPConfig{
+			Endpoint:           f.otlpEndpoint,
+			Protocol:           f.otlpProtocol,
+			Timeout:            f.otlpTimeout,
+			Headers:            f.otlpHeaders,
+			ResourceAttributes: attributes,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, s)
+	}
+
+	return sinks, nil
+}
+
+// sendMetrics sends metrics to every sink, even if some of them fail
+func sendMetrics(ctx context.Context, sinks []sink.Sink, gatherer prometheus.Gatherer, logger log.Logger) error {
+	var failed error
+
+	for _, s := range sinks {
+		if err := s.Send(ctx, gatherer); err != nil {
+			level.Error(logger).Log("msg", "Failed to send metrics", "sink", s.Name(), "err", err)
+			failed = fmt.Errorf("sink %s: %w", s.Name(), err)
+			continue
+		}
+
+		level.Debug(logger).Log("msg", "Metrics sent", "sink", s.Name())
+	}
+
+	return failed
+}
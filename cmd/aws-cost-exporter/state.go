@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// stateFlags select where state is stored
+type stateFlags struct {
+	backend string
+
+	s3URL string
+
+	kubernetesName      string
+	kubernetesNamespace string
+}
+
+func (f *stateFlags) register(app *kingpin.Application) {
+	app.Flag(
+		"state.backend",
+		"Where to store exporter state, s3, configmap and secret let stateless deployments avoid downloading all reports on restart. One of: [file, s3, configmap, secret]",
+	).Default("file").EnumVar(&f.backend, "file", "s3", state.KindConfigMap, state.KindSecret)
+
+	app.Flag(
+		"state.s3-url",
+		"URL of S3 object to store state in with s3 backend, e.g. s3://bucket/aws-cost-exporter/state.json",
+	).StringVar(&f.s3URL)
+
+	app.Flag(
+		"state.kubernetes-name",
+		"Name of ConfigMap or Secret to store state in with configmap and secret backends.",
+	).Default("aws-cost-exporter-state").StringVar(&f.kubernetesName)
+
+	app.Flag(
+		"state.kubernetes-namespace",
+		"Namespace of ConfigMap or Secret to store state in, namespace of the pod if empty.",
+	).StringVar(&f.kubernetesNamespace)
+}
+
+// build returns nil for file backend, which is
+// the default of state.Config with --state-path
+func (f *stateFlags) build() (state.Backend, error) {
+	switch f.backend {
+	case "s3":
+		cfg, err := awsconfig.LoadDefaultConfig(context.TODO(), awsconfig.WithDefaultRegion("us-east-1"))
+		if err != nil {
+			return nil, err
+		}
+
+		return state.NewS3Backend(s3.NewFromConfig(cfg), f.s3URL)
+
+	case state.KindConfigMap, state.KindSecret:
+		return state.NewKubernetesBackend(f.backend, f.kubernetesNamespace, f.kubernetesName)
+
+	default:
+		return nil, nil
+	}
+}
+
+// runStateShowCommand prints state migrated to the current version,
+// stored state itself is left untouched
+func runStateShowCommand(config *state.Config, w io.Writer, logger log.Logger) error {
+	st, version, err := readState(config)
+	if err != nil {
+		return err
+	}
+
+	if version != state.Version {
+		level.Info(logger).Log("msg", "Stored state has older version, run state migrate to upgrade it", "backend", config.Backend().Name(), "version", version, "current", state.Version)
+	}
+
+	data, err := json.MarshalIndent(st, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// runStateMigrateCommand upgrades stored state to the current version,
+// file backend keeps the previous version as backup
+func runStateMigrateCommand(config *state.Config, w io.Writer) error {
+	st, version, err := readState(config)
+	if err != nil {
+		return err
+	}
+
+	if version == state.Version {
+		_, err := fmt.Fprintf(w, "%s: state is up to date, version %s\n", config.Backend().Name(), version)
+		return err
+	}
+
+	if err := st.Save(config); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s: migrated state from version %s to %s\n", config.Backend().Name(), version, state.Version)
+	return err
+}
+
+// Unlike state.Load, doesn't fall back to backup or empty
+// state, so operators see what is actually stored
+func readState(config *state.Config) (*state.State, string, error) {
+	backend := config.Backend()
+
+	data, err := backend.Read()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if data == nil {
+		return nil, "", fmt.Errorf("%s: no state is stored", backend.Name())
+	}
+
+	st, version, err := state.Decode(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", backend.Name(), err)
+	}
+
+	return st, version, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/version"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/collector"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+type statusHandler struct {
+	config   *state.Config
+	state    *state.State
+	gatherer *intervalGatherer
+	interval time.Duration
+	logger   log.Logger
+}
+
+type status struct {
+	Version string `json:"version"`
+	Bucket  string `json:"bucket"`
+	Report  string `json:"report"`
+
+	Schedule struct {
+		Interval    string     `json:"interval"`
+		LastRefresh *time.Time `json:"lastRefresh,omitempty"`
+		NextRefresh *time.Time `json:"nextRefresh,omitempty"`
+	} `json:"schedule"`
+
+	Periods []periodStatus `json:"periods"`
+	Files   []fileStatus   `json:"files"`
+	Queries []queryStatus  `json:"queries"`
+}
+
+type periodStatus struct {
+	Period             state.BillingPeriod `json:"period"`
+	Status             string              `json:"status"`
+	ReportLastModified *time.Time          `json:"reportLastModified,omitempty"`
+	AssemblyId         string              `json:"assemblyId,omitempty"`
+	ReportHash         string              `json:"reportHash,omitempty"`
+}
+
+type fileStatus struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+type queryStatus struct {
+	Name string `json:"name"`
+	state.QueryStatus
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<html>
+	<head><title>AWS Cost Exporter - Status</title></head>
+	<body>
+	<h1>AWS Cost Exporter</h1>
+	<p>Version {{ .Version }}, report <code>{{ .Report }}</code> in bucket <code>{{ .Bucket }}</code></p>
+
+	<h2>Schedule</h2>
+	<table>
+		<tr><th align="left">Interval</th><td>{{ .Schedule.Interval }}</td></tr>
+		<tr><th align="left">Last refresh</th><td>{{ with .Schedule.LastRefresh }}{{ . }}{{ else }}never{{ end }}</td></tr>
+		<tr><th align="left">Next refresh</th><td>{{ with .Schedule.NextRefresh }}{{ . }}{{ else }}unknown{{ end }}</td></tr>
+	</table>
+
+	<h2>Billing periods</h2>
+	<table>
+		<tr><th align="left">Period</th><th align="left">Status</th><th align="left">Report last modified</th><th align="left">Assembly ID</th><th align="left">Report SHA-256</th></tr>
+		{{- range .Periods }}
+		<tr><td>{{ .Period }}</td><td>{{ .Status }}</td><td>{{ with .ReportLastModified }}{{ . }}{{ end }}</td><td>{{ .AssemblyId }}</td><td>{{ .ReportHash }}</td></tr>
+		{{- end }}
+	</table>
+
+	<h2>Repository</h2>
+	<table>
+		<tr><th align="left">File</th><th align="right">Size</th><th align="left">Modified</th></tr>
+		{{- range .Files }}
+		<tr><td>{{ .Name }}</td><td align="right">{{ .Size }}</td><td>{{ .ModTime }}</td></tr>
+		{{- end }}
+	</table>
+
+	<h2>Queries</h2>
+	<table>
+		<tr><th align="left">Query</th><th align="left">Last run</th><th align="right">Duration</th><th align="right">Rows</th><th align="left">Cached</th><th align="left">Last error</th></tr>
+		{{- range .Queries }}
+		<tr><td>{{ .Name }}</td><td>{{ .LastRun }}</td><td align="right">{{ .Duration }}</td><td align="right">{{ .Rows }}</td><td>{{ if .Cached }}yes{{ else }}no{{ end }}</td><td>{{ if .LastError }}{{ .LastErrorTime }}: {{ .LastError }}{{ end }}</td></tr>
+		{{- end }}
+	</table>
+
+	<p><a href="?format=json">JSON</a></p>
+	</body>
+	</html>`))
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s, err := h.collect()
+	if err != nil {
+		level.Error(h.logger).Log("msg", "Unable to collect status", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Rendered into buffer, so errors can still be reported with status code
+	body := &bytes.Buffer{}
+	contentType := "text/html; charset=utf-8"
+
+	if r.URL.Query().Get("format") == "json" {
+		contentType = "application/json"
+
+		encoder := json.NewEncoder(body)
+		encoder.SetIndent("", "    ")
+		err = encoder.Encode(s)
+	} else {
+		err = statusTemplate.Execute(body, s)
+	}
+
+	if err != nil {
+		level.Error(h.logger).Log("msg", "Unable to render status", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	if _, err := body.WriteTo(w); err != nil {
+		level.Debug(h.logger).Log("msg", "Unable to write status", "err", err)
+	}
+}
+
+func (h *statusHandler) collect() (*status, error) {
+	s := &status{
+		Version: version.Version,
+		Bucket:  h.config.BucketName,
+		Report:  h.config.ReportName,
+	}
+
+	s.Schedule.Interval = h.interval.String()
+	if lastRun := h.gatherer.lastRun.Load(); lastRun != nil {
+		nextRun := lastRun.Add(h.interval)
+
+		s.Schedule.LastRefresh = lastRun
+		s.Schedule.NextRefresh = &nextRun
+	}
+
+	h.state.RLock()
+
+	for _, period := range h.state.Periods {
+		p := periodStatus{
+			Period:     period,
+			Status:     collector.PeriodStatus(period, h.state.ReportInvoiceId[period.String()], h.config.FinalizationGrace),
+			AssemblyId: h.state.ReportAssemblyId[period.String()],
+			ReportHash: h.state.ReportHash[period.String()],
+		}
+
+		if lastModified, ok := h.state.ReportLastModified[period.String()]; ok {
+			p.ReportLastModified = &lastModified
+		}
+
+		s.Periods = append(s.Periods, p)
+	}
+
+	for name, query := range h.state.Queries {
+		s.Queries = append(s.Queries, queryStatus{
+			Name:        name,
+			QueryStatus: *query,
+		})
+	}
+
+	h.state.RUnlock()
+
+	sort.Slice(s.Queries, func(i, j int) bool { return s.Queries[i].Name < s.Queries[j].Name })
+
+	items, err := os.ReadDir(filepath.Join(h.config.RepositoryPath, "data"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+
+		info, err := item.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		s.Files = append(s.Files, fileStatus{
+			Name:    item.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return s, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/exporter-toolkit/web"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/processor"
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Synthetic report with the most common columns of AWS Cost and Usage Report
+//
+//go:embed sample/report.csv
+var sampleReport []byte
+
+// Sample report is exposed as several billing periods,
+// so queries over report-1.csv and report-2.csv can be validated too
+var samplePeriods = []string{"20230801", "20230901", "20231001"}
+
+// runValidateCommand runs all queries against a sample report and
+// prints diagnostics, failing if any of them is an error
+func runValidateCommand(config *state.Config, samplePath string, webConfigFile string, w io.Writer, logger log.Logger) error {
+	failed := false
+
+	if webConfigFile != "" {
+		if err := web.Validate(webConfigFile); err != nil {
+			fmt.Fprintf(w, "%s: error: %s\n", webConfigFile, err)
+			failed = true
+		}
+	}
+
+	sample := sampleReport
+	if samplePath != "" {
+		data, err := os.ReadFile(samplePath)
+		if err != nil {
+			return err
+		}
+
+		sample = data
+	}
+
+	repositoryPath, err := os.MkdirTemp("", "aws-cost-exporter-validate-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(repositoryPath)
+
+	if err := os.Mkdir(filepath.Join(repositoryPath, "data"), 0750); err != nil {
+		return err
+	}
+
+	for _, period := range samplePeriods {
+		if err := os.WriteFile(filepath.Join(repositoryPath, "data", period+"-sample.csv"), sample, 0640); err != nil {
+			return err
+		}
+	}
+
+	diagnostics, err := processor.Validate(context.Background(), &state.Config{
+		RepositoryPath: repositoryPath,
+		QueriesPath:    config.QueriesPath,
+		QueryVariables: config.QueryVariables,
+		QueryEngine:    config.QueryEngine,
+		Rollups:        config.Rollups,
+	}, logger)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range diagnostics {
+		d.Query = filepath.Join(config.QueriesPath, d.Query)
+		fmt.Fprintln(w, d.String())
+
+		if d.Severity == processor.SeverityError {
+			failed = true
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("validation failed")
+	}
+
+	level.Info(logger).Log("msg", "Validation succeeded", "queries", config.QueriesPath)
+
+	return nil
+}
@@ -11,7 +11,7 @@ select
 
     SUM(`lineItem/UnblendedCost`) as metric_cost,
     `lineItem/CurrencyCode` as `currency`
-from `report-current.csv`
+from `{{.Report}}`
 where `lineItem/UnblendedCost` > 0
 group by
     `bill/BillingPeriodStartDate`,
@@ -3,7 +3,7 @@
     let
       version = "0.4.0";
       chartVersion = "0.1.8";
-      vendorSha256 = "sha256-U4Yh+VNS1lBz4wwPl7q4RlYZdvRdj3IBS5P3XxlzrVI=";
+      vendorSha256 = "sha256-Sox+eflcDjK4b8kDu3MwcK19LF3bnXukynlXW3xuvRA=";
       dockerPackageTag = "st8ed/aws-cost-exporter:${version}";
 
       src = with lib; builtins.path {
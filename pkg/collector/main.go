@@ -1,67 +1,314 @@
 package collector
 
 import (
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/st8ed/aws-cost-exporter/pkg/fetcher"
+	"github.com/st8ed/aws-cost-exporter/pkg/processor"
 	"github.com/st8ed/aws-cost-exporter/pkg/state"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+// Column of reports filled once AWS finalizes the billing period
+const invoiceIdColumn = "bill/InvoiceId"
+
 func Prefetch(
 	state *state.State,
 	config *state.Config,
 	client *s3.Client,
-	registry *prometheus.Registry,
 	periods []state.BillingPeriod,
 	logger log.Logger,
 ) error {
 	for i, period := range periods {
 		isLast := (i == len(periods)-1)
-		_, isCached := state.ReportLastModified[string(period)]
-
-		if !isCached || isLast {
-			if _, err := UpdateReport(state, config, client, &period, logger); err != nil {
+		if !isReportCached(state, config, period) || isLast || IsFinalizing(state, config, period) {
+			if _, _, err := UpdateReport(state, config, client, &period, logger); err != nil {
 				return err
 			}
 		}
+
+		// State of older versions doesn't know invoice IDs of cached reports
+		if err := checkInvoiceId(state, config, period); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// IsFinalizing tells whether the period ended within the grace window
+// and isn't finalized yet, so its report may still be updated by AWS
+func IsFinalizing(state *state.State, config *state.Config, period state.BillingPeriod) bool {
+	state.RLock()
+	invoiceId := state.ReportInvoiceId[period.String()]
+	state.RUnlock()
+
+	return invoiceId == "" && period.WithinGrace(config.FinalizationGrace)
+}
+
+// UpdateReport downloads report of the period if its manifest was modified.
+// Manifest may be modified without changes of the report, e.g. with the same
+// assembly, so dataChanged tells whether queries have to be rerun
 func UpdateReport(
 	state *state.State, config *state.Config,
 	client *s3.Client,
 	period *state.BillingPeriod,
 	logger log.Logger,
-) (updated bool, err error) {
-	lastModified, ok := state.ReportLastModified[string(*period)]
-	if !ok {
-		lastModified = time.Time{}
+) (updated bool, dataChanged bool, err error) {
+	lastModified := time.Time{}
+	if isReportCached(state, config, *period) {
+		state.RLock()
+		lastModified = state.ReportLastModified[period.String()]
+		state.RUnlock()
 	}
 
 	level.Debug(logger).Log("msg", "Attempt to download new report manifest", "period", period, "lastModified", lastModified)
 	manifest, err := fetcher.GetReportManifest(config, client, period, &lastModified)
 	if err != nil {
-		return false, err
+		return false, false, err
 	}
 
 	if manifest == nil {
 		level.Debug(logger).Log("msg", "Report manifest didn't change", "period", period, "lastModified", lastModified)
-		return false, nil
+		return false, false, nil
+	}
+
+	reportFile, err := fetcher.GetReportFile(config, manifest)
+	if err != nil {
+		return false, false, err
+	}
+
+	state.RLock()
+	previousAssemblyId := state.ReportAssemblyId[period.String()]
+	previousHash := state.ReportHash[period.String()]
+	state.RUnlock()
+
+	_, statErr := os.Stat(reportFile)
+	cached := statErr == nil && manifest.AssemblyId == previousAssemblyId && previousHash != ""
+
+	if err := fetchReport(config, client, manifest, logger); err != nil {
+		return false, false, err
+	}
+
+	hash := previousHash
+	if !cached {
+		if hash, err = fileHash(reportFile); err != nil {
+			return false, false, err
+		}
+	}
+
+	updateState(state, period, lastModified, manifest, hash)
+
+	if hash == previousHash {
+		level.Info(logger).Log("msg", "Report manifest was modified, but report data didn't change", "period", period, "assemblyId", manifest.AssemblyId)
+		return true, false, nil
+	}
+
+	if err := checkInvoiceId(state, config, *period); err != nil {
+		return false, false, err
+	}
+
+	return true, true, nil
+}
+
+// RefetchReport downloads report manifest and report file
+// of the period again, even if they are already cached
+func RefetchReport(
+	state *state.State, config *state.Config,
+	client *s3.Client,
+	period *state.BillingPeriod,
+	logger log.Logger,
+) error {
+	lastModified := time.Time{}
+
+	level.Info(logger).Log("msg", "Forcing report refetch", "period", period)
+	manifest, err := fetcher.GetReportManifest(config, client, period, &lastModified)
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		return fmt.Errorf("report manifest for period %s not found", *period)
+	}
+
+	reportFile, err := fetcher.GetReportFile(config, manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := fetcher.DownloadReport(config, client, manifest, logger); err != nil {
+		return err
 	}
 
+	if err := processor.UpdateRollups(config, logger); err != nil {
+		return err
+	}
+
+	hash, err := fileHash(reportFile)
+	if err != nil {
+		return err
+	}
+
+	updateState(state, period, lastModified, manifest, hash)
+
+	return checkInvoiceId(state, config, *period)
+}
+
+// Downloads report and builds its rollups, so they are
+// ready before queries are run
+func fetchReport(config *state.Config, client *s3.Client, manifest *fetcher.ReportManifest, logger log.Logger) error {
 	if err := fetcher.FetchReport(config, client, manifest, logger); err != nil {
-		return false, err
+		return err
+	}
+
+	return processor.UpdateRollups(config, logger)
+}
+
+// Reports known from state may be missing in the repository, e.g. if state
+// is stored in S3 while the repository is on an ephemeral volume
+func isReportCached(state *state.State, config *state.Config, period state.BillingPeriod) bool {
+	state.RLock()
+	_, ok := state.ReportLastModified[period.String()]
+	assemblyId := state.ReportAssemblyId[period.String()]
+	_, hasManifest := state.ReportManifest[period.String()]
+	state.RUnlock()
+
+	// Assembly ID and manifest details are unknown in state of older
+	// versions, the report is checked once its manifest is downloaded again
+	if !ok || !hasManifest || assemblyId == "" {
+		return false
+	}
+
+	_, err := os.Stat(reportPath(config, period, assemblyId))
+
+	return err == nil
+}
+
+// Looks up invoice ID in the cached report of the period, which is
+// filled once AWS finalizes the period. Report of an assembly doesn't
+// change, so each one is scanned once, and an invoiced period stays
+// invoiced, so its later assemblies aren't scanned at all
+func checkInvoiceId(state *state.State, config *state.Config, period state.BillingPeriod) error {
+	state.RLock()
+	invoiceId := state.ReportInvoiceId[period.String()]
+	checked := state.ReportInvoiceAssemblyId[period.String()]
+	assemblyId := state.ReportAssemblyId[period.String()]
+	state.RUnlock()
+
+	if invoiceId != "" || assemblyId == "" || assemblyId == checked {
+		return nil
+	}
+
+	invoiceId, err := reportInvoiceId(reportPath(config, period, assemblyId))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	state.Lock()
+	state.ReportInvoiceId[period.String()] = invoiceId
+	state.ReportInvoiceAssemblyId[period.String()] = assemblyId
+	state.Unlock()
+
+	return nil
+}
+
+// Returns the first invoice ID in the report, empty
+// if the report has no invoice ID column or values
+func reportInvoiceId(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReaderSize(f, 1<<20))
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err == io.EOF {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	column := -1
+	for i, name := range header {
+		if name == invoiceIdColumn {
+			column = i
+			break
+		}
+	}
+
+	if column < 0 {
+		return "", nil
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+
+		if column < len(record) && record[column] != "" {
+			return record[column], nil
+		}
+	}
+}
+
+// Report files are named after the period start, see fetcher.GetReportFile
+func reportPath(config *state.Config, period state.BillingPeriod, assemblyId string) string {
+	return filepath.Join(config.RepositoryPath, "data", period.Start.Format("20060102")+"-"+assemblyId+".csv")
+}
+
+func updateState(state *state.State, period *state.BillingPeriod, lastModified time.Time, manifest *fetcher.ReportManifest, hash string) {
+	state.Lock()
+	state.ReportLastModified[period.String()] = lastModified
+	state.ReportAssemblyId[period.String()] = manifest.AssemblyId
+	state.ReportHash[period.String()] = hash
+	state.ReportManifest[period.String()] = manifestInfo(manifest)
+	state.Unlock()
+}
+
+// Period of the manifest is validated by fetcher.GetReportManifest
+func manifestInfo(manifest *fetcher.ReportManifest) *state.ManifestInfo {
+	start, end, _ := manifest.Period()
+
+	return &state.ManifestInfo{
+		BillingPeriodStart: start,
+		BillingPeriodEnd:   end,
+		Compression:        manifest.Compression,
+		Parts:              len(manifest.ReportKeys),
+		Columns:            len(manifest.Columns),
+	}
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
 
-	state.ReportLastModified[string(*period)] = lastModified
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
 
-	return true, nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
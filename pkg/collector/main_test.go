@@ -0,0 +1,202 @@
+package collector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-kit/log"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+const (
+	testReport  = "identity/LineItemId,bill/InvoiceId,lineItem/UnblendedCost\na,,0.5\n"
+	testInvoice = "identity/LineItemId,bill/InvoiceId,lineItem/UnblendedCost\na,123,0.5\n"
+)
+
+// Serves manifest of a single billing period and its report in one part
+type fakeBucket struct {
+	mu           sync.Mutex
+	assemblyId   string
+	report       string
+	lastModified time.Time
+	downloads    int
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if strings.HasSuffix(r.URL.Path, "-Manifest.json") {
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !b.lastModified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Last-Modified", b.lastModified.UTC().Format(http.TimeFormat))
+		fmt.Fprintf(w, `{
+			"assemblyId": %q,
+			"compression": "GZIP",
+			"contentType": "text/csv",
+			"billingPeriod": {"start": "20231001T000000.000Z", "end": "20231101T000000.000Z"},
+			"bucket": "bucket",
+			"reportKeys": ["report/20231001-20231101/%s/report-00001.csv.gz"]
+		}`, b.assemblyId, b.assemblyId)
+		return
+	}
+
+	b.downloads++
+
+	zw := gzip.NewWriter(w)
+	zw.Write([]byte(b.report))
+	zw.Close()
+}
+
+func TestUpdateReport(t *testing.T) {
+	period := state.BillingPeriod{
+		Start: time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	cached := time.Date(2023, 10, 5, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		assemblyId string
+		report     string
+		modified   time.Time
+
+		updated, dataChanged bool
+		downloads            int
+		invoiceId            string
+	}{
+		{"manifest not modified", "a", testReport, cached, false, false, 0, ""},
+		{"same assembly", "a", testReport, cached.Add(time.Hour), true, false, 0, ""},
+		{"new assembly with same data", "b", testReport, cached.Add(time.Hour), true, false, 1, ""},
+		{"new assembly with new data", "b", testInvoice, cached.Add(time.Hour), true, true, 1, "123"},
+	}
+
+	for _, c := range cases {
+		bucket := &fakeBucket{assemblyId: c.assemblyId, report: c.report, lastModified: c.modified}
+		server := httptest.NewServer(bucket)
+
+		client := s3.New(s3.Options{
+			Region:           "us-east-1",
+			Credentials:      credentials.NewStaticCredentialsProvider("key", "secret", ""),
+			EndpointResolver: s3.EndpointResolverFromURL(server.URL),
+			UsePathStyle:     true,
+			RetryMaxAttempts: 1,
+		})
+
+		config := &state.Config{RepositoryPath: t.TempDir(), BucketName: "bucket", ReportName: "report"}
+		if err := os.MkdirAll(filepath.Join(config.RepositoryPath, "data"), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		// Report of assembly a is cached before the manifest is modified
+		path := reportPath(config, period, "a")
+		if err := os.WriteFile(path, []byte(testReport), 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := fileHash(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		st := state.Init()
+		st.ReportLastModified[period.String()] = cached
+		st.ReportAssemblyId[period.String()] = "a"
+		st.ReportHash[period.String()] = hash
+		st.ReportInvoiceId[period.String()] = ""
+		st.ReportManifest[period.String()] = &state.ManifestInfo{BillingPeriodStart: period.Start, BillingPeriodEnd: period.End}
+
+		updated, dataChanged, err := UpdateReport(st, config, client, &period, log.NewNopLogger())
+		server.Close()
+
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if updated != c.updated || dataChanged != c.dataChanged {
+			t.Errorf("%s: UpdateReport() = %v, %v, expected %v, %v", c.name, updated, dataChanged, c.updated, c.dataChanged)
+		}
+
+		if bucket.downloads != c.downloads {
+			t.Errorf("%s: report downloaded %d times, expected %d", c.name, bucket.downloads, c.downloads)
+		}
+
+		if assemblyId := st.ReportAssemblyId[period.String()]; assemblyId != c.assemblyId {
+			t.Errorf("%s: state has assembly %s, expected %s", c.name, assemblyId, c.assemblyId)
+		}
+
+		if invoiceId := st.ReportInvoiceId[period.String()]; invoiceId != c.invoiceId {
+			t.Errorf("%s: state has invoice ID %q, expected %q", c.name, invoiceId, c.invoiceId)
+		}
+
+		data, err := os.ReadFile(reportPath(config, period, c.assemblyId))
+		if err != nil || !bytes.Equal(data, []byte(c.report)) {
+			t.Errorf("%s: cached report %q (%v), expected %q", c.name, data, err, c.report)
+		}
+	}
+}
+
+func TestCheckInvoiceId(t *testing.T) {
+	period := state.BillingPeriod{
+		Start: time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	config := &state.Config{RepositoryPath: t.TempDir()}
+	if err := os.MkdirAll(filepath.Join(config.RepositoryPath, "data"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reports of both assemblies have invoice ID, so skipped scans leave state as is
+	for _, assemblyId := range []string{"a", "b"} {
+		if err := os.WriteFile(reportPath(config, period, assemblyId), []byte(testInvoice), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name                      string
+		invoiceId, checked        string
+		assemblyId                string
+		expected, expectedChecked string
+	}{
+		{"unchecked assembly", "", "", "a", "123", "a"},
+		{"checked assembly", "", "a", "a", "", "a"},
+		{"new assembly", "", "a", "b", "123", "b"},
+		{"invoiced period", "999", "a", "b", "999", "a"},
+		{"missing report", "", "a", "c", "", "a"},
+	}
+
+	for _, c := range cases {
+		st := state.Init()
+		st.ReportAssemblyId[period.String()] = c.assemblyId
+		st.ReportInvoiceId[period.String()] = c.invoiceId
+		st.ReportInvoiceAssemblyId[period.String()] = c.checked
+
+		if err := checkInvoiceId(st, config, period); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if invoiceId, checked := st.ReportInvoiceId[period.String()], st.ReportInvoiceAssemblyId[period.String()]; invoiceId != c.expected || checked != c.expectedChecked {
+			t.Errorf("%s: invoice ID %q of assembly %q, expected %q of %q", c.name, invoiceId, checked, c.expected, c.expectedChecked)
+		}
+	}
+}
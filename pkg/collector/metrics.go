@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Statuses of billing periods
+const (
+	// The period didn't end yet
+	PeriodOpen = "open"
+	// The period ended, but AWS didn't issue the invoice yet,
+	// so costs of the period may still change
+	PeriodClosing = "closing"
+	// Report of the period has invoice ID, costs are final
+	PeriodFinal = "final"
+	// The finalization grace passed without the invoice, so the report
+	// isn't checked for updates anymore and its costs may be incomplete
+	PeriodUnfinalized = "unfinalized"
+)
+
+var periodStatuses = []string{PeriodOpen, PeriodClosing, PeriodFinal, PeriodUnfinalized}
+
+var periodStatusDesc = prometheus.NewDesc(
+	"aws_cost_exporter_billing_period_status",
+	"Status of the billing period: open, closing until AWS issues the invoice, final, or unfinalized if the invoice wasn't issued within the finalization grace.",
+	[]string{"period", "status"}, nil,
+)
+
+var reportInfoDesc = prometheus.NewDesc(
+	"aws_cost_exporter_report_info",
+	"Details of the last downloaded report manifest of the billing period.",
+	[]string{"period", "report", "assembly_id", "billing_period_start", "billing_period_end", "compression", "parts", "columns"}, nil,
+)
+
+var manifestLastModifiedDesc = prometheus.NewDesc(
+	"aws_cost_exporter_report_manifest_last_modified_timestamp_seconds",
+	"When the report manifest of the billing period was last updated by AWS.",
+	[]string{"period", "report"}, nil,
+)
+
+var manifestAgeDesc = prometheus.NewDesc(
+	"aws_cost_exporter_report_manifest_age_seconds",
+	"Seconds since the report manifest of the billing period was last updated by AWS.",
+	[]string{"period", "report"}, nil,
+)
+
+// PeriodStatus returns status of the period with invoice ID found in its report
+func PeriodStatus(period state.BillingPeriod, invoiceId string, grace time.Duration) string {
+	if !period.IsPastDue() {
+		return PeriodOpen
+	}
+
+	if invoiceId != "" {
+		return PeriodFinal
+	}
+
+	if period.WithinGrace(grace) {
+		return PeriodClosing
+	}
+
+	return PeriodUnfinalized
+}
+
+// PeriodCollector exports metrics about billing periods known from state.
+// They are collected with other metrics once per interval, so age
+// of manifests is as of the last collection
+type PeriodCollector struct {
+	state  *state.State
+	config *state.Config
+}
+
+func NewPeriodCollector(state *state.State, config *state.Config) *PeriodCollector {
+	return &PeriodCollector{state, config}
+}
+
+// Describe implements prometheus.Collector.
+func (c *PeriodCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- periodStatusDesc
+	ch <- reportInfoDesc
+	ch <- manifestLastModifiedDesc
+	ch <- manifestAgeDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *PeriodCollector) Collect(ch chan<- prometheus.Metric) {
+	c.state.RLock()
+	defer c.state.RUnlock()
+
+	for _, period := range c.state.Periods {
+		status := PeriodStatus(period, c.state.ReportInvoiceId[period.String()], c.config.FinalizationGrace)
+
+		for _, s := range periodStatuses {
+			value := 0.0
+			if s == status {
+				value = 1
+			}
+
+			ch <- prometheus.MustNewConstMetric(periodStatusDesc, prometheus.GaugeValue, value, period.String(), s)
+		}
+
+		lastModified, ok := c.state.ReportLastModified[period.String()]
+		manifest := c.state.ReportManifest[period.String()]
+		if !ok || manifest == nil {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			reportInfoDesc, prometheus.GaugeValue, 1,
+			period.String(),
+			c.config.ReportName,
+			c.state.ReportAssemblyId[period.String()],
+			manifest.BillingPeriodStart.Format(time.RFC3339),
+			manifest.BillingPeriodEnd.Format(time.RFC3339),
+			manifest.Compression,
+			strconv.Itoa(manifest.Parts),
+			strconv.Itoa(manifest.Columns),
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			manifestLastModifiedDesc, prometheus.GaugeValue, float64(lastModified.UnixNano())/1e9,
+			period.String(), c.config.ReportName,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			manifestAgeDesc, prometheus.GaugeValue, time.Since(lastModified).Seconds(),
+			period.String(), c.config.ReportName,
+		)
+	}
+}
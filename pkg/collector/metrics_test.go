@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+func TestPeriodStatus(t *testing.T) {
+	month := func(start time.Time) state.BillingPeriod {
+		return state.BillingPeriod{Start: start, End: start.AddDate(0, 1, 0)}
+	}
+
+	now := time.Now().UTC()
+	current := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	grace := 7 * 24 * time.Hour
+
+	cases := []struct {
+		name      string
+		period    state.BillingPeriod
+		invoiceId string
+		grace     time.Duration
+		status    string
+	}{
+		{"current", month(current), "", grace, PeriodOpen},
+		{"current with invoice", month(current), "123", grace, PeriodOpen},
+		{"ended within grace", state.BillingPeriod{Start: now.AddDate(0, -1, 0), End: now.Add(-time.Hour)}, "", grace, PeriodClosing},
+		{"ended within grace with invoice", state.BillingPeriod{Start: now.AddDate(0, -1, 0), End: now.Add(-time.Hour)}, "123", grace, PeriodFinal},
+		{"ended before grace", month(current.AddDate(0, -3, 0)), "", grace, PeriodUnfinalized},
+		{"ended before grace with invoice", month(current.AddDate(0, -3, 0)), "123", grace, PeriodFinal},
+		{"without grace", state.BillingPeriod{Start: now.AddDate(0, -1, 0), End: now.Add(-time.Hour)}, "", 0, PeriodUnfinalized},
+	}
+
+	for _, c := range cases {
+		if status := PeriodStatus(c.period, c.invoiceId, c.grace); status != c.status {
+			t.Errorf("%s: PeriodStatus() = %s, expected %s", c.name, status, c.status)
+		}
+	}
+}
+
+func TestPeriodCollector(t *testing.T) {
+	period := state.BillingPeriod{
+		Start: time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	st := state.Init()
+	st.Periods = []state.BillingPeriod{period}
+	st.ReportInvoiceId[period.String()] = "123"
+	st.ReportAssemblyId[period.String()] = "abc"
+	st.ReportLastModified[period.String()] = time.Date(2023, 11, 5, 12, 0, 0, 0, time.UTC)
+	st.ReportManifest[period.String()] = &state.ManifestInfo{
+		BillingPeriodStart: period.Start,
+		BillingPeriodEnd:   period.End,
+		Compression:        "GZIP",
+		Parts:              2,
+		Columns:            100,
+	}
+
+	collector := NewPeriodCollector(st, &state.Config{ReportName: "test"})
+
+	expected := `
+# HELP aws_cost_exporter_report_info Details of the last downloaded report manifest of the billing period.
+# TYPE aws_cost_exporter_report_info gauge
+aws_cost_exporter_report_info{assembly_id="abc",billing_period_end="2023-11-01T00:00:00Z",billing_period_start="2023-10-01T00:00:00Z",columns="100",compression="GZIP",parts="2",period="20231001-20231101",report="test"} 1
+# HELP aws_cost_exporter_report_manifest_last_modified_timestamp_seconds When the report manifest of the billing period was last updated by AWS.
+# TYPE aws_cost_exporter_report_manifest_last_modified_timestamp_seconds gauge
+aws_cost_exporter_report_manifest_last_modified_timestamp_seconds{period="20231001-20231101",report="test"} 1.6991856e+09
+# HELP aws_cost_exporter_billing_period_status Status of the billing period: open, closing until AWS issues the invoice, final, or unfinalized if the invoice wasn't issued within the finalization grace.
+# TYPE aws_cost_exporter_billing_period_status gauge
+aws_cost_exporter_billing_period_status{period="20231001-20231101",status="closing"} 0
+aws_cost_exporter_billing_period_status{period="20231001-20231101",status="final"} 1
+aws_cost_exporter_billing_period_status{period="20231001-20231101",status="open"} 0
+aws_cost_exporter_billing_period_status{period="20231001-20231101",status="unfinalized"} 0
+`
+
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"aws_cost_exporter_report_info",
+		"aws_cost_exporter_report_manifest_last_modified_timestamp_seconds",
+		"aws_cost_exporter_billing_period_status",
+	); err != nil {
+		t.Error(err)
+	}
+
+	if count := testutil.CollectAndCount(collector, "aws_cost_exporter_report_manifest_age_seconds"); count != 1 {
+		t.Errorf("collected %d manifest ages, expected 1", count)
+	}
+}
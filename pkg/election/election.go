@@ -0,0 +1,25 @@
+package election
+
+import (
+	"context"
+)
+
+// Elector decides which replica of the exporter is the leader.
+// Only the leader fetches reports and computes metrics
+type Elector interface {
+	Name() string
+
+	// Campaign acquires or renews leadership of this replica if it is
+	// possible and returns the current leader, nil if it is unknown
+	Campaign(ctx context.Context) (*Leader, error)
+
+	// Resign releases leadership, so other replicas
+	// don't have to wait until it expires
+	Resign(ctx context.Context) error
+}
+
+// Leader identifies a replica and tells other ones where to fetch metrics from
+type Leader struct {
+	Identity string `json:"identity"`
+	URL      string `json:"url"`
+}
@@ -0,0 +1,111 @@
+//go:build unix
+
+package election
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FileLock elects the replica holding exclusive lock of the file, e.g. on
+// storage shared by replicas for local testing. The lock is released by
+// the kernel when the process exits, so leadership never has to expire
+type FileLock struct {
+	path string
+	self Leader
+
+	mu sync.Mutex
+	// Open while this replica holds the lock
+	file *os.File
+}
+
+func NewFileLock(path string, self Leader) (*FileLock, error) {
+	return &FileLock{
+		path: path,
+		self: self,
+	}, nil
+}
+
+func (l *FileLock) Name() string {
+	return "file lock " + l.path
+}
+
+// The file holds the leader, which is written once the lock is acquired
+func (l *FileLock) Campaign(ctx context.Context) (*Leader, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		return &l.self, nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, err
+		}
+
+		data, err := os.ReadFile(l.path)
+		if err != nil {
+			return nil, err
+		}
+
+		// The leader may be writing the file right now
+		leader := &Leader{}
+		if err := json.Unmarshal(data, leader); err != nil {
+			return nil, nil
+		}
+
+		return leader, nil
+	}
+
+	data, err := json.Marshal(&l.self)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.WriteAt(data, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l.file = f
+
+	return &l.self, nil
+}
+
+func (l *FileLock) Resign(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	// Closing the file releases the lock
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package election
+
+import (
+	"context"
+	"errors"
+)
+
+// FileLock requires flock(2), which is available only on Unix systems
+type FileLock struct{}
+
+func NewFileLock(path string, self Leader) (*FileLock, error) {
+	return nil, errors.New("file lock election is supported only on Unix systems")
+}
+
+func (l *FileLock) Name() string {
+	return "file lock"
+}
+
+func (l *FileLock) Campaign(ctx context.Context) (*Leader, error) {
+	return nil, errors.New("file lock election is supported only on Unix systems")
+}
+
+func (l *FileLock) Resign(ctx context.Context) error {
+	return nil
+}
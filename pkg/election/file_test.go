@@ -0,0 +1,64 @@
+//go:build unix
+
+package election
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leader")
+	ctx := context.Background()
+
+	a, err := NewFileLock(path, Leader{Identity: "a", URL: "http://a:9090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewFileLock(path, Leader{Identity: "b", URL: "http://b:9090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name     string
+		elector  *FileLock
+		resign   bool
+		expected string
+	}{
+		{"a acquires the lock", a, false, "a"},
+		{"b sees a", b, false, "a"},
+		{"a renews", a, false, "a"},
+		{"a resigns", a, true, ""},
+		{"b acquires the lock", b, false, "b"},
+		{"a sees b", a, false, "b"},
+	}
+
+	for _, step := range steps {
+		if step.resign {
+			if err := step.elector.Resign(ctx); err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+			continue
+		}
+
+		leader, err := step.elector.Campaign(ctx)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if leader == nil || leader.Identity != step.expected {
+			t.Fatalf("%s: Campaign() = %v, expected leader %s", step.name, leader, step.expected)
+		}
+
+		if leader.URL != "http://"+step.expected+":9090" {
+			t.Errorf("%s: leader URL %s", step.name, leader.URL)
+		}
+	}
+
+	if err := b.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,182 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/kubernetes"
+)
+
+// Annotation of the Lease with URL of the leader
+const leaderURLAnnotation = "aws-cost-exporter/leader-url"
+
+// Layout of MicroTime fields of Kubernetes objects
+const microTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+// Lease elects the leader with Kubernetes Lease object like client-go
+// leader election does. Expiration is measured with the local clock since
+// the lease was last seen changing, so clocks of replicas may differ
+type Lease struct {
+	client    *kubernetes.Client
+	namespace string
+	name      string
+	duration  time.Duration
+	self      Leader
+
+	mu sync.Mutex
+	// Holder and renew time of the lease seen last and when they changed
+	observed     string
+	observedTime time.Time
+}
+
+type lease struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Metadata   kubernetes.ObjectMeta `json:"metadata"`
+	Spec       leaseSpec             `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// NewLease returns elector using the Lease in the namespace,
+// the namespace of the pod is used if it is empty
+func NewLease(namespace string, name string, duration time.Duration, self Leader) (*Lease, error) {
+	client, err := kubernetes.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace == "" {
+		namespace = client.Namespace
+	}
+
+	return &Lease{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		duration:  duration,
+		self:      self,
+	}, nil
+}
+
+func (l *Lease) Name() string {
+	return fmt.Sprintf("lease %s/%s", l.namespace, l.name)
+}
+
+func (l *Lease) Campaign(ctx context.Context) (*Leader, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	current := &lease{}
+	err := l.client.Do(ctx, http.MethodGet, l.objectPath(), nil, current)
+	if kubernetes.IsNotFound(err) {
+		current = &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata: kubernetes.ObjectMeta{
+				Name:      l.name,
+				Namespace: l.namespace,
+			},
+		}
+
+		if err := l.acquire(ctx, current, now, http.MethodPost, l.collectionPath()); err != nil {
+			return nil, err
+		}
+
+		return &l.self, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if observed := current.Spec.HolderIdentity + "\xff" + current.Spec.RenewTime; observed != l.observed {
+		l.observed = observed
+		l.observedTime = now
+	}
+
+	holder := current.Spec.HolderIdentity
+	duration := time.Duration(current.Spec.LeaseDurationSeconds) * time.Second
+
+	if holder != "" && holder != l.self.Identity && now.Before(l.observedTime.Add(duration)) {
+		return &Leader{
+			Identity: holder,
+			URL:      current.Metadata.Annotations[leaderURLAnnotation],
+		}, nil
+	}
+
+	// Lease is held by this replica, released or expired, resourceVersion
+	// of the object makes sure only one replica takes it over
+	if err := l.acquire(ctx, current, now, http.MethodPut, l.objectPath()); err != nil {
+		return nil, err
+	}
+
+	return &l.self, nil
+}
+
+func (l *Lease) acquire(ctx context.Context, current *lease, now time.Time, method string, path string) error {
+	if current.Spec.HolderIdentity != l.self.Identity {
+		current.Spec.AcquireTime = now.UTC().Format(microTimeLayout)
+		current.Spec.LeaseTransitions++
+	}
+
+	current.Spec.HolderIdentity = l.self.Identity
+	current.Spec.LeaseDurationSeconds = int(l.duration / time.Second)
+	current.Spec.RenewTime = now.UTC().Format(microTimeLayout)
+
+	if current.Metadata.Annotations == nil {
+		current.Metadata.Annotations = map[string]string{}
+	}
+	current.Metadata.Annotations[leaderURLAnnotation] = l.self.URL
+
+	if err := l.client.Do(ctx, method, path, current, current); err != nil {
+		if kubernetes.IsConflict(err) {
+			return fmt.Errorf("%s was updated by another replica: %w", l.Name(), err)
+		}
+
+		return err
+	}
+
+	l.observed = current.Spec.HolderIdentity + "\xff" + current.Spec.RenewTime
+	l.observedTime = now
+
+	return nil
+}
+
+func (l *Lease) Resign(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := &lease{}
+	if err := l.client.Do(ctx, http.MethodGet, l.objectPath(), nil, current); err != nil {
+		return err
+	}
+
+	if current.Spec.HolderIdentity != l.self.Identity {
+		return nil
+	}
+
+	current.Spec.HolderIdentity = ""
+	current.Spec.LeaseDurationSeconds = 1
+	current.Spec.RenewTime = time.Now().UTC().Format(microTimeLayout)
+	delete(current.Metadata.Annotations, leaderURLAnnotation)
+
+	return l.client.Do(ctx, http.MethodPut, l.objectPath(), current, nil)
+}
+
+func (l *Lease) collectionPath() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.namespace)
+}
+
+func (l *Lease) objectPath() string {
+	return l.collectionPath() + "/" + l.name
+}
@@ -35,15 +35,38 @@ type ReportManifest struct {
 	} `json:"billingPeriod"`
 	Bucket     string   `json:"bucket"`
 	ReportKeys []string `json:"reportKeys"`
+	Columns    []struct {
+		Category string `json:"category"`
+		Name     string `json:"name"`
+	} `json:"columns"`
+}
+
+// Layout of billing period bounds in manifests, e.g. 20231001T000000.000Z.
+// Fractional seconds are accepted by time.Parse without being in the layout
+const manifestTimeLayout = "20060102T150405Z"
+
+// Period returns bounds of the billing period covered by the report
+func (manifest *ReportManifest) Period() (start time.Time, end time.Time, err error) {
+	if start, err = time.Parse(manifestTimeLayout, manifest.BillingPeriod.Start); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if end, err = time.Parse(manifestTimeLayout, manifest.BillingPeriod.End); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return start, end, nil
 }
 
 type SortRecentFirst []state.BillingPeriod
 
 func (a SortRecentFirst) Len() int           { return len(a) }
 func (a SortRecentFirst) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a SortRecentFirst) Less(i, j int) bool { return a[i] < a[j] }
+func (a SortRecentFirst) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
 
-func GetBillingPeriods(config *state.Config, client *s3.Client) ([]state.BillingPeriod, error) {
+// GetBillingPeriods lists the most recent billing periods in the bucket.
+// Prefixes of the report which aren't billing periods are skipped
+func GetBillingPeriods(config *state.Config, client *s3.Client, logger log.Logger) ([]state.BillingPeriod, error) {
 	params := &s3.ListObjectsV2Input{
 		Bucket:    aws.String(config.BucketName),
 		Prefix:    aws.String("/" + config.ReportName + "/"),
@@ -65,7 +88,8 @@ func GetBillingPeriods(config *state.Config, client *s3.Client) ([]state.Billing
 			)
 
 			if err != nil {
-				return nil, err
+				level.Warn(logger).Log("msg", "Skipping prefix which is not a billing period", "prefix", *obj.Prefix, "err", err)
+				continue
 			}
 
 			periods = append(periods, *period)
@@ -86,7 +110,7 @@ func GetReportManifest(config *state.Config, client *s3.Client, period *state.Bi
 		Bucket: aws.String(config.BucketName),
 		Key: aws.String(fmt.Sprintf(
 			"/%s/%s/%s-Manifest.json",
-			config.ReportName, string(*period), config.ReportName,
+			config.ReportName, period, config.ReportName,
 		)),
 		IfModifiedSince: aws.Time(*lastModified),
 	}
@@ -127,31 +151,56 @@ func GetReportManifest(config *state.Config, client *s3.Client, period *state.Bi
 		return nil, fmt.Errorf("report manifest contains no report keys")
 	}
 
+	if _, _, err := manifest.Period(); err != nil {
+		return nil, fmt.Errorf("report manifest contains malformed billing period: %w", err)
+	}
+
 	return manifest, nil
 }
 
-func FetchReport(config *state.Config, client *s3.Client, manifest *ReportManifest, logger log.Logger) error {
-	periodStart, err := time.Parse("20060102T150405Z", manifest.BillingPeriod.Start)
+func GetReportFile(config *state.Config, manifest *ReportManifest) (string, error) {
+	periodStart, _, err := manifest.Period()
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	reportFile := filepath.Join(
+	return filepath.Join(
 		config.RepositoryPath, "data",
 		periodStart.Format("20060102")+"-"+manifest.AssemblyId+".csv",
-	)
+	), nil
+}
+
+func FetchReport(config *state.Config, client *s3.Client, manifest *ReportManifest, logger log.Logger) error {
+	reportFile, err := GetReportFile(config, manifest)
+	if err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(reportFile); !errors.Is(err, os.ErrNotExist) {
 		level.Warn(logger).Log("msg", "Report file already exists, skipping download", "file", reportFile)
 		return nil
 	}
 
+	return DownloadReport(config, client, manifest, logger)
+}
+
+// DownloadReport downloads report even if it is already cached. It is written
+// to a temporary file renamed over the cached one only once it is complete,
+// so the cached report is kept if the download fails
+func DownloadReport(config *state.Config, client *s3.Client, manifest *ReportManifest, logger log.Logger) error {
+	reportFile, err := GetReportFile(config, manifest)
+	if err != nil {
+		return err
+	}
+
 	level.Info(logger).Log("msg", "Fetching report", "file", reportFile, "parts", len(manifest.ReportKeys))
 
 	f, err := os.Create(reportFile + ".tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(f.Name())
+	defer f.Close()
 
 	for reportPart, reportKey := range manifest.ReportKeys {
 		level.Info(logger).Log("msg", "Fetching report part", "file", reportFile, "part", reportPart)
@@ -0,0 +1,161 @@
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Credentials of the pod service account
+const serviceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client calls Kubernetes API with credentials of the pod service account.
+// The exporter needs only a few objects, so plain JSON over HTTP is used
+// instead of client-go with its dependencies
+type Client struct {
+	client *http.Client
+	host   string
+	// Projected tokens are rotated by kubelet, so the file
+	// is read for each request
+	tokenPath string
+
+	// Namespace of the pod
+	Namespace string
+}
+
+// StatusError is returned for responses with unsuccessful status,
+// Kubernetes API describes them with Status object
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected response status %d", e.Code)
+	}
+
+	return e.Message
+}
+
+func IsNotFound(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusNotFound
+}
+
+// IsConflict tells whether the object was modified or created concurrently
+func IsConflict(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && se.Code == http.StatusConflict
+}
+
+func NewInClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("Kubernetes API is available only in a pod, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	// Fail early if the pod has no token mounted
+	if _, err := os.Stat(serviceAccountPath + "/token"); err != nil {
+		return nil, err
+	}
+
+	ca, err := os.ReadFile(serviceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountPath)
+	}
+
+	namespace, err := os.ReadFile(serviceAccountPath + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenPath: serviceAccountPath + "/token",
+		Namespace: strings.TrimSpace(string(namespace)),
+	}, nil
+}
+
+// Do sends request object encoded as JSON, if it isn't nil,
+// and decodes response object into response
+func (c *Client) Do(ctx context.Context, method string, path string, request interface{}, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(data)
+	}
+
+	token, err := os.ReadFile(c.tokenPath)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		se := &StatusError{Code: resp.StatusCode}
+		json.Unmarshal(data, se)
+
+		return se
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	return json.Unmarshal(data, response)
+}
+
+// ObjectMeta holds fields of object metadata used by the exporter
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
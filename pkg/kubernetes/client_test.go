@@ -0,0 +1,61 @@
+package kubernetes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientRereadsToken(t *testing.T) {
+	var authorization string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	client := &Client{client: server.Client(), host: server.URL, tokenPath: tokenPath}
+
+	for _, token := range []string{"first", "rotated"} {
+		if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.Do(context.Background(), http.MethodGet, "/api/v1/namespaces/default/configmaps/state", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := "Bearer " + token; authorization != expected {
+			t.Errorf("Authorization = %q, expected %q", authorization, expected)
+		}
+	}
+}
+
+func TestClientStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"kind":"Status","code":409,"message":"the object has been modified"}`))
+	}))
+	defer server.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{client: server.Client(), host: server.URL, tokenPath: tokenPath}
+
+	err := client.Do(context.Background(), http.MethodPut, "/api/v1/namespaces/default/configmaps/state", struct{}{}, nil)
+	if !IsConflict(err) || IsNotFound(err) {
+		t.Fatalf("Do() = %v, expected conflict", err)
+	}
+
+	if err.Error() != "the object has been modified" {
+		t.Errorf("Error() = %q, expected message of Status", err.Error())
+	}
+}
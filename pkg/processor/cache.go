@@ -0,0 +1,287 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Matches tables of reports and rollups referenced by a query, however
+// they are quoted. Matches in other places, e.g. string literals, only
+// make the query depend on more files
+var tableReference = regexp.MustCompile(`\b((?:report|rollup)-[A-Za-z0-9_-]+)(?:\.csv)?\b`)
+
+// cachedResult holds metrics computed by a query along with the key
+// identifying its inputs, i.e. query text and files of referenced tables
+type cachedResult struct {
+	Key      string         `json:"key"`
+	LastRun  time.Time      `json:"lastRun"`
+	Rows     int            `json:"rows"`
+	Families []cachedFamily `json:"families"`
+}
+
+type cachedFamily struct {
+	Name      string         `json:"name"`
+	Column    string         `json:"column"`
+	Type      metricType     `json:"type"`
+	Labels    []string       `json:"labels"`
+	Buckets   []float64      `json:"buckets,omitempty"`
+	Quantiles []float64      `json:"quantiles,omitempty"`
+	Samples   []cachedSample `json:"samples"`
+}
+
+type cachedSample struct {
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp,omitempty"`
+}
+
+func queryCacheDir(config *state.Config) string {
+	return filepath.Join(config.RepositoryPath, "cache", "queries")
+}
+
+// runCachedQuery returns metrics of the query from cache if its inputs didn't
+// change since the last run and REFRESH interval of the query didn't pass,
+// otherwise it runs the query and stores its results
+func runCachedQuery(ctx context.Context, db *sql.DB, config *state.Config, data *TemplateData, query Query) (*metricSet, int, bool, error) {
+	set := newMetricSet()
+
+	if !config.QueryCache {
+		count, err := runQuery(ctx, db, data, set, query, nil)
+		return set, count, false, err
+	}
+
+	rendered, err := renderQuery(query, data)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	header, err := parseHeader(rendered.Text)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	key, err := queryKey(config, rendered)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if key == "" {
+		count, err := runQuery(ctx, db, data, set, query, nil)
+		return set, count, false, err
+	}
+
+	file := filepath.Join(queryCacheDir(config), query.Name+".json")
+
+	if result, err := loadCachedResult(file); err == nil && result.Key == key {
+		if header.refresh == 0 || time.Since(result.LastRun) < header.refresh {
+			if cached, err := result.metricSet(query.Name); err == nil {
+				return cached, result.Rows, true, nil
+			}
+		}
+	}
+
+	start := time.Now()
+
+	count, err := runQuery(ctx, db, data, set, query, nil)
+	if err != nil {
+		return nil, count, false, err
+	}
+
+	if err := storeCachedResult(file, newCachedResult(key, start, count, set, query.Name)); err != nil {
+		return nil, count, false, err
+	}
+
+	return set, count, false, nil
+}
+
+// Key of query inputs: engine, rendered text and identity of files
+// behind tables it references, so a query is rerun only when reports
+// of periods it depends on are updated. It is empty if the query
+// references no tables of reports or rollups, such queries aren't cached
+func queryKey(config *state.Config, query Query) (string, error) {
+	files := map[string][]string{}
+
+	tables, err := reportTables(config)
+	if err != nil {
+		return "", err
+	}
+
+	for _, table := range tables {
+		files[table.Table] = []string{filepath.Join("data", table.File)}
+	}
+
+	rollups, err := rollupTables(config)
+	if err != nil {
+		return "", err
+	}
+
+	for _, table := range rollups {
+		files[table.Table] = []string{filepath.Join("rollups", table.File)}
+	}
+
+	sources, err := unionSources(config)
+	if err != nil {
+		return "", err
+	}
+
+	for _, source := range sources {
+		files[unionTable] = append(files[unionTable], filepath.Join("data", filepath.Base(source.path)))
+	}
+
+	matches := tableReference.FindAllStringSubmatch(query.Text, -1)
+	if len(matches) == 0 {
+		return "", nil
+	}
+
+	digest := sha256.New()
+	fmt.Fprintf(digest, "%s\x00%s\x00", config.QueryEngine, query.Text)
+
+	for _, match := range matches {
+		table := match[1] + ".csv"
+
+		fmt.Fprintf(digest, "%s\x00", table)
+
+		for _, file := range files[table] {
+			info, err := os.Stat(filepath.Join(config.RepositoryPath, file))
+			if err != nil {
+				return "", err
+			}
+
+			fmt.Fprintf(digest, "%s\x00%d\x00%d\x00", file, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func newCachedResult(key string, lastRun time.Time, rows int, set *metricSet, query string) *cachedResult {
+	result := &cachedResult{
+		Key:      key,
+		LastRun:  lastRun,
+		Rows:     rows,
+		Families: make([]cachedFamily, 0, len(set.order)),
+	}
+
+	for _, name := range set.order {
+		f := set.families[name]
+
+		cf := cachedFamily{
+			Name:      name,
+			Column:    f.queryColumns[query],
+			Type:      f.typ,
+			Labels:    f.queryLabels[query],
+			Buckets:   f.buckets,
+			Quantiles: f.quantiles,
+			Samples:   make([]cachedSample, len(f.samples)),
+		}
+
+		for i, s := range f.samples {
+			cf.Samples[i] = cachedSample{
+				Labels:    s.labels,
+				Value:     s.value,
+				Timestamp: s.timestamp,
+			}
+		}
+
+		result.Families = append(result.Families, cf)
+	}
+
+	return result
+}
+
+func (result *cachedResult) metricSet(query string) (*metricSet, error) {
+	set := newMetricSet()
+
+	for _, cf := range result.Families {
+		options := &metricOptions{
+			typ:       cf.Type,
+			buckets:   cf.Buckets,
+			quantiles: cf.Quantiles,
+		}
+
+		f, err := set.family(cf.Name, query, cf.Column, options, cf.Labels)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range cf.Samples {
+			f.samples = append(f.samples, sample{
+				query:     query,
+				labels:    s.Labels,
+				value:     s.Value,
+				timestamp: s.Timestamp,
+			})
+		}
+	}
+
+	return set, nil
+}
+
+func loadCachedResult(file string) (*cachedResult, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &cachedResult{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func storeCachedResult(file string, result *cachedResult) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(file+".tmp", data, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// Forget results of queries which were removed from queries directory
+func pruneQueryCache(config *state.Config, queries []Query) error {
+	items, err := os.ReadDir(queryCacheDir(config))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		found := false
+		for _, query := range queries {
+			if query.Name+".json" == item.Name() {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			if err := os.Remove(filepath.Join(queryCacheDir(config), item.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+func TestQueryKey(t *testing.T) {
+	config := &state.Config{
+		RepositoryPath: writeTestReport(t),
+		QueryEngine:    EngineCSVQ,
+	}
+
+	previous := filepath.Join(config.RepositoryPath, "data", "20230901-previous.csv")
+	if err := os.WriteFile(previous, []byte(testReport), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		text string
+		// Whether the key depends on the current or previous report
+		current, previous bool
+	}{
+		{"select * from `report-current.csv`", true, false},
+		{"select * from `report-current`", true, false},
+		{`select * from "report-current.csv"`, true, false},
+		{"select * from report-current", true, false},
+		{"select * from `report-1.csv`", false, true},
+		{"select * from `report-all.csv`", true, true},
+		{"select * from `report-current.csv` join `report-1.csv` using (x)", true, true},
+		{"select 1", false, false},
+	}
+
+	modified := time.Now()
+
+	for _, c := range cases {
+		key, err := queryKey(config, Query{Name: "test", Text: c.text})
+		if err != nil {
+			t.Fatalf("%s: %v", c.text, err)
+		}
+
+		if (key == "") != (!c.current && !c.previous) {
+			t.Errorf("%s: key %q, expected it to be empty only without tables", c.text, key)
+			continue
+		}
+
+		for file, depends := range map[string]bool{
+			filepath.Join(config.RepositoryPath, "data", "20231001-test.csv"): c.current,
+			previous: c.previous,
+		} {
+			modified = modified.Add(time.Second)
+			if err := os.Chtimes(file, modified, modified); err != nil {
+				t.Fatal(err)
+			}
+
+			updated, err := queryKey(config, Query{Name: "test", Text: c.text})
+			if err != nil {
+				t.Fatalf("%s: %v", c.text, err)
+			}
+
+			if changed := updated != key; changed != depends {
+				t.Errorf("%s: key changed %v after %s was modified, expected %v", c.text, changed, filepath.Base(file), depends)
+			}
+
+			key = updated
+		}
+	}
+}
@@ -7,29 +7,30 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/st8ed/aws-cost-exporter/pkg/state"
 
-	"strings"
-
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 
 	_ "github.com/mithrandie/csvq-driver"
 )
 
-func Compute(ctx context.Context, config *state.Config, registry *prometheus.Registry, logger log.Logger) error {
-	if err := updateSymlinks(config); err != nil {
-		return err
+// Compute runs all queries and returns a new registry with resulting metrics.
+// Queries are loaded before any of them is run and the registry is returned
+// only if all of them succeed, so callers can keep serving previous metrics
+func Compute(ctx context.Context, state *state.State, config *state.Config, logger log.Logger) (*prometheus.Registry, error) {
+	queries, err := LoadQueries(config)
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := sql.Open("csvq", config.RepositoryPath)
+	db, err := Open(config, logger)
 	if err != nil {
-		return err
-	} else {
-		level.Debug(logger).Log("msg", "Opened database", "repository", config.RepositoryPath)
+		return nil, err
 	}
 	defer func() {
 		if err := db.Close(); err != nil {
@@ -38,147 +39,477 @@ func Compute(ctx context.Context, config *state.Config, registry *prometheus.Reg
 		level.Debug(logger).Log("msg", "Closed database")
 	}()
 
-	items, err := os.ReadDir(config.QueriesPath)
+	data, err := newTemplateData(config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, item := range items {
-		if item.IsDir() {
-			continue
+	if err := prepareUnionTable(config, data, queries, logger); err != nil {
+		return nil, err
+	}
+
+	set := newMetricSet()
+
+	for _, query := range queries {
+		level.Debug(logger).Log("msg", "Running query", "name", query.Name)
+
+		start := time.Now()
+		qset, count, cached, err := runCachedQuery(ctx, db, config, data, query)
+		if err == nil {
+			err = set.merge(qset, query.Name)
 		}
+		updateQueryStatus(state, query.Name, start, count, cached, err)
 
-		// TODO: Basic file validation (extension)
-		query, err := os.ReadFile(filepath.Join(config.QueriesPath, item.Name()))
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("query %s: %w", query.Name, err)
 		}
+	}
 
-		level.Debug(logger).Log("msg", "Running query", "name", item.Name())
+	pruneQueryStatus(state, queries)
 
-		rows, err := db.QueryContext(ctx, string(query))
-		if err != nil {
-			return err
+	if err := pruneQueryCache(config, queries); err != nil {
+		level.Warn(logger).Log("msg", "Unable to prune query cache", "err", err)
+	}
+
+	level.Debug(logger).Log("msg", "Updating metrics registry")
+	registry := prometheus.NewRegistry()
+	if err := set.register(registry); err != nil {
+		return nil, err
+	}
+
+	return registry, nil
+}
+
+// Query engines
+const (
+	EngineCSVQ   = "csvq"
+	EngineSQLite = "sqlite"
+)
+
+// Open exposes reports of the repository as tables
+// (report-current.csv, report-1.csv, ...) and opens it as database
+// with the engine from config. For csvq, union table report-all.csv
+// is built on demand when queries are run
+func Open(config *state.Config, logger log.Logger) (*sql.DB, error) {
+	if err := UpdateRollups(config, logger); err != nil {
+		return nil, err
+	}
+
+	switch config.QueryEngine {
+	case "", EngineCSVQ:
+	case EngineSQLite:
+		return openSQLite(config, logger)
+	default:
+		return nil, fmt.Errorf("unknown query engine: %s", config.QueryEngine)
+	}
+
+	if err := updateSymlinks(config); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("csvq", config.RepositoryPath)
+	if err != nil {
+		return nil, err
+	}
+
+	level.Debug(logger).Log("msg", "Opened database", "repository", config.RepositoryPath)
+
+	return db, nil
+}
+
+// Table holds raw result of a query
+type Table struct {
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// MetricsError is returned along with the raw result
+// of a query which can't be exported as metrics
+type MetricsError struct {
+	Err error
+}
+
+func (e *MetricsError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MetricsError) Unwrap() error {
+	return e.Err
+}
+
+// Execute runs a single query and returns its raw result
+// along with the registry of metrics it exports. If the result
+// can't be exported as metrics, it is returned with *MetricsError
+func Execute(ctx context.Context, db *sql.DB, config *state.Config, query Query, logger log.Logger) (*Table, *prometheus.Registry, error) {
+	data, err := newTemplateData(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := prepareUnionTable(config, data, []Query{query}, logger); err != nil {
+		return nil, nil, err
+	}
+
+	query, err = renderQuery(query, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	table, err := queryTable(ctx, db, query.Text)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header, err := parseHeader(query.Text)
+	if err != nil {
+		return table, nil, &MetricsError{err}
+	}
+
+	set := newMetricSet()
+	if _, err := ingestMetrics(set, query.Name, header.metrics, &tableRows{table: table}, nil); err != nil {
+		return table, nil, &MetricsError{err}
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := set.register(registry); err != nil {
+		return table, nil, &MetricsError{err}
+	}
+
+	return table, registry, nil
+}
+
+func queryTable(ctx context.Context, db *sql.DB, text string) (*Table, error) {
+	rows, err := db.QueryContext(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	table := &Table{Columns: columns}
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+
+		for i := range values {
+			ptrs[i] = &values[i]
 		}
 
-		level.Debug(logger).Log("msg", "Updating metrics registry")
-		err = ingestMetrics(registry, rows)
-		if err != nil {
-			return err
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
 		}
+
+		table.Rows = append(table.Rows, values)
+	}
+
+	return table, rows.Err()
+}
+
+// resultRows is a result set metrics are ingested from, *sql.Rows or *tableRows
+type resultRows interface {
+	Columns() ([]string, error)
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+}
+
+// tableRows reads a result set already fetched into Table
+type tableRows struct {
+	table *Table
+	row   int
+}
+
+func (r *tableRows) Columns() ([]string, error) {
+	return r.table.Columns, nil
+}
+
+func (r *tableRows) Next() bool {
+	if r.row >= len(r.table.Rows) {
+		return false
+	}
+
+	r.row++
+	return true
+}
+
+func (r *tableRows) Scan(dest ...interface{}) error {
+	values := r.table.Rows[r.row-1]
+	if len(dest) != len(values) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(values), len(dest))
+	}
+
+	for i, value := range values {
+		*dest[i].(*interface{}) = value
 	}
 
 	return nil
 }
 
-func ingestMetrics(registry *prometheus.Registry, rows *sql.Rows) error {
+func (r *tableRows) Err() error {
+	return nil
+}
+
+func runQuery(ctx context.Context, db *sql.DB, data *TemplateData, set *metricSet, query Query, table *Table) (int, error) {
+	query, err := renderQuery(query, data)
+	if err != nil {
+		return 0, err
+	}
+
+	header, err := parseHeader(query.Text)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, query.Text)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	return ingestMetrics(set, query.Name, header.metrics, rows, table)
+}
+
+func updateQueryStatus(st *state.State, name string, start time.Time, rows int, cached bool, err error) {
+	st.Lock()
+	defer st.Unlock()
+
+	status, ok := st.Queries[name]
+	if !ok {
+		status = &state.QueryStatus{}
+		st.Queries[name] = status
+	}
+
+	status.LastRun = start
+	status.Duration = time.Since(start)
+	status.Rows = rows
+	status.Cached = cached
+
+	// A successful run clears the failure, so status shows the query as healthy
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorTime = start
+	} else {
+		status.LastError = ""
+		status.LastErrorTime = time.Time{}
+	}
+}
+
+// Forget about queries which were removed from queries directory
+func pruneQueryStatus(st *state.State, queries []Query) {
+	st.Lock()
+	defer st.Unlock()
+
+	for name := range st.Queries {
+		found := false
+		for _, query := range queries {
+			if query.Name == name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			delete(st.Queries, name)
+		}
+	}
+}
+
+// Reserved column with explicit timestamp of samples in the row
+const timestampColumn = "timestamp_"
+
+func ingestMetrics(set *metricSet, query string, options map[string]*metricOptions, rows resultRows, table *Table) (int, error) {
 	columns, err := rows.Columns()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if len(columns) == 0 {
-		return errors.New("malformed query: there are no columns in result set")
+		return 0, errors.New("malformed query: there are no columns in result set")
 	}
 
 	labelNames := make([]string, 0)
-	labelValuePtrs := make([]*string, 0)
+	labelColumns := make([]int, 0)
 
 	metricNames := make([]string, 0)
-	metricValuePtrs := make([]*float64, 0)
+	metricColumns := make([]int, 0)
+	metricOpts := make([]*metricOptions, 0)
 
-	rowValuePtrs := make([]interface{}, len(columns))
+	seen := make(map[string]bool, len(columns))
+	timestampColumnIndex := -1
 
 	for i, column := range columns {
-		if strings.HasPrefix(column, "metric_") {
-			// FIXME: Check metric name using regexp
-			value := new(float64)
+		if seen[column] {
+			return 0, &columnError{column, errors.New("duplicate column name")}
+		}
+		seen[column] = true
 
-			metricNames = append(metricNames, strings.TrimPrefix(column, "metric_"))
-			metricValuePtrs = append(metricValuePtrs, value)
-			rowValuePtrs[i] = value
+		if column == timestampColumn {
+			timestampColumnIndex = i
+			continue
+		}
+
+		name, o, isMetric, err := columnOptions(column, options)
+		if err != nil {
+			return 0, &columnError{column, err}
+		}
+
+		if isMetric {
+			metricNames = append(metricNames, name)
+			metricColumns = append(metricColumns, i)
+			metricOpts = append(metricOpts, o)
 		} else {
-			value := new(string)
+			if err := validateLabelName(column); err != nil {
+				return 0, &columnError{column, err}
+			}
 
 			labelNames = append(labelNames, column)
-			labelValuePtrs = append(labelValuePtrs, value)
-			rowValuePtrs[i] = value
+			labelColumns = append(labelColumns, i)
 		}
 	}
 
-	gauges := make([]*prometheus.GaugeVec, len(metricNames))
+	for name := range options {
+		found := false
+		for _, n := range metricNames {
+			if n == name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("query header declares metric %s, but there is no column exporting it", name)
+		}
+	}
+
+	families := make([]*family, len(metricNames))
 
 	for i, name := range metricNames {
-		gauges[i] = prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name: fmt.Sprintf("aws_report_%s", name),
-			},
-			labelNames,
-		)
-		if err := registry.Register(gauges[i]); err != nil {
-			if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
-				gauges[i] = are.ExistingCollector.(*prometheus.GaugeVec)
-			} else {
-				return err
-			}
+		families[i], err = set.family(name, query, columns[metricColumns[i]], metricOpts[i], labelNames)
+		if err != nil {
+			return 0, &columnError{columns[metricColumns[i]], err}
 		}
+	}
 
+	if table != nil {
+		table.Columns = columns
 	}
 
+	count := 0
+
 	for rows.Next() {
+		rowValues := make([]interface{}, len(columns))
+		rowValuePtrs := make([]interface{}, len(columns))
+
+		for i := range rowValues {
+			rowValuePtrs[i] = &rowValues[i]
+		}
+
 		if err := rows.Scan(rowValuePtrs...); err != nil {
 			if err == sql.ErrNoRows {
 				break
 			} else {
-				return err
+				return count, err
+			}
+		}
+
+		count++
+
+		if table != nil {
+			table.Rows = append(table.Rows, rowValues)
+		}
+
+		var timestamp time.Time
+
+		if timestampColumnIndex >= 0 {
+			timestamp, err = timestampValue(rowValues[timestampColumnIndex])
+			if err != nil {
+				return count, &columnError{timestampColumn, fmt.Errorf("row %d: %w", count, err)}
+			}
+		}
+
+		labels := make(map[string]string, len(labelColumns))
+
+		for i, column := range labelColumns {
+			value, err := labelValue(rowValues[column])
+			if err != nil {
+				return count, &columnError{columns[column], fmt.Errorf("row %d: %w", count, err)}
 			}
-		} else {
-			labelValues := make([]string, len(labelValuePtrs))
 
-			for i := range labelValuePtrs {
-				labelValues[i] = *labelValuePtrs[i]
+			labels[labelNames[i]] = value
+		}
+
+		for i, family := range families {
+			value, err := metricValue(rowValues[metricColumns[i]])
+			if err != nil {
+				return count, &columnError{columns[metricColumns[i]], fmt.Errorf("row %d: %w", count, err)}
 			}
 
-			for i, gauge := range gauges {
-				gauge.WithLabelValues(labelValues...).Set(*metricValuePtrs[i])
+			if family.typ == counterType && value < 0 {
+				return count, &columnError{columns[metricColumns[i]], fmt.Errorf("row %d: counter value must not be negative: %g", count, value)}
 			}
+
+			family.samples = append(family.samples, sample{
+				query:     query,
+				labels:    labels,
+				value:     value,
+				timestamp: timestamp,
+			})
 		}
 	}
 
-	return nil
+	return count, rows.Err()
 }
 
 func updateSymlinks(config *state.Config) error {
-	items, err := os.ReadDir(filepath.Join(config.RepositoryPath, "data"))
+	tables, err := reportTables(config)
 	if err != nil {
 		return err
 	}
 
-	names := make([]string, 0)
+	wanted := map[string]bool{}
 
-	for _, item := range items {
-		if item.IsDir() {
-			continue
+	for _, table := range tables {
+		source := filepath.Join(config.RepositoryPath, table.Table)
+		target := filepath.Join(".", "data", table.File)
+
+		if err := symlink(source, target); err != nil {
+			return err
 		}
-		names = append(names, item.Name())
+		wanted[table.Table] = true
 	}
 
-	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	rollups, err := rollupTables(config)
+	if err != nil {
+		return err
+	}
 
-	for i, name := range names {
-		var source string
+	for _, table := range rollups {
+		source := filepath.Join(config.RepositoryPath, table.Table)
+		target := filepath.Join(".", "rollups", table.File)
 
-		if i == 0 {
-			source = "report-current.csv"
-		} else {
-			source = fmt.Sprintf("report-%d.csv", i)
+		if err := symlink(source, target); err != nil {
+			return err
 		}
+		wanted[table.Table] = true
+	}
 
-		source = filepath.Join(config.RepositoryPath, source)
-		target := filepath.Join(".", "data", name)
+	// Remove tables of rollups which are no longer configured
+	// and of periods which are no longer in the repository
+	items, err := os.ReadDir(config.RepositoryPath)
+	if err != nil {
+		return err
+	}
 
-		if err := symlink(source, target); err != nil {
-			return err
+	for _, item := range items {
+		if (strings.HasPrefix(item.Name(), "rollup-") || reportTableName.MatchString(item.Name())) && !wanted[item.Name()] {
+			if err := os.Remove(filepath.Join(config.RepositoryPath, item.Name())); err != nil {
+				return err
+			}
 		}
 	}
 
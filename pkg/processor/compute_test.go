@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+func TestUpdateQueryStatus(t *testing.T) {
+	st := state.Init()
+	start := time.Date(2023, 11, 5, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		err       error
+		lastError string
+		errorTime time.Time
+	}{
+		{errors.New("no such table"), "no such table", start},
+		{nil, "", time.Time{}},
+		{errors.New("timeout"), "timeout", start.Add(2 * time.Hour)},
+	}
+
+	for i, c := range cases {
+		run := start.Add(time.Duration(i) * time.Hour)
+		updateQueryStatus(st, "costs", run, 1, false, c.err)
+
+		status := st.Queries["costs"]
+		if !status.LastRun.Equal(run) {
+			t.Errorf("run %d: last run %v, expected %v", i, status.LastRun, run)
+		}
+		if status.LastError != c.lastError || !status.LastErrorTime.Equal(c.errorTime) {
+			t.Errorf("run %d: last error %q at %v, expected %q at %v", i, status.LastError, status.LastErrorTime, c.lastError, c.errorTime)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// metricSet accumulates samples of all queries before they are exported,
+// so metrics with the same name produced by different queries can be
+// merged into a single metric family with union of their label names
+type metricSet struct {
+	families map[string]*family
+	order    []string
+}
+
+type family struct {
+	name    string
+	typ     metricType
+	labels  []string
+	queries []string
+	samples []sample
+
+	// Histogram buckets or summary quantiles
+	buckets   []float64
+	quantiles []float64
+
+	// Label names and column of the metric in each query
+	queryLabels  map[string][]string
+	queryColumns map[string]string
+}
+
+type metricType string
+
+const (
+	gaugeType     metricType = "gauge"
+	counterType   metricType = "counter"
+	histogramType metricType = "histogram"
+	summaryType   metricType = "summary"
+)
+
+// Column prefixes marking metrics, type of metric_ columns
+// is declared in the query header and defaults to gauge
+var metricPrefixes = []struct {
+	prefix string
+	typ    metricType
+}{
+	{"metric_", ""},
+	{"gauge_", gaugeType},
+	{"counter_", counterType},
+	{"histogram_", histogramType},
+	{"summary_", summaryType},
+}
+
+// Summaries without QUANTILES header export these quantiles
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+type sample struct {
+	query     string
+	labels    map[string]string
+	value     float64
+	timestamp time.Time
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		families: map[string]*family{},
+	}
+}
+
+// columnError points to the column of query result which caused an error
+type columnError struct {
+	column string
+	err    error
+}
+
+func (e *columnError) Error() string {
+	return fmt.Sprintf("column %s: %s", e.column, e.err)
+}
+
+func (e *columnError) Unwrap() error {
+	return e.err
+}
+
+// conflictError describes samples of the same metric
+// with identical labels produced by different queries
+type conflictError struct {
+	metric  string
+	queries [2]string
+	labels  string
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf(
+		"metric %s: queries %s and %s produce samples with identical labels %s, add a label to distinguish them",
+		e.metric, e.queries[0], e.queries[1], e.labels,
+	)
+}
+
+func validateMetricName(name string) error {
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		return fmt.Errorf("invalid metric name: %s", name)
+	}
+
+	return nil
+}
+
+func validateLabelName(name string) error {
+	if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+		return fmt.Errorf("invalid label name: %s", name)
+	}
+
+	return nil
+}
+
+// columnOptions resolves name and options of the metric exported by the column
+// from its prefix and the query header
+func columnOptions(column string, options map[string]*metricOptions) (string, *metricOptions, bool, error) {
+	for _, p := range metricPrefixes {
+		if !strings.HasPrefix(column, p.prefix) {
+			continue
+		}
+
+		name := "aws_report_" + strings.TrimPrefix(column, p.prefix)
+		if err := validateMetricName(name); err != nil {
+			return "", nil, true, err
+		}
+
+		o := metricOptions{typ: p.typ}
+		if header, ok := options[name]; ok {
+			o = *header
+
+			if p.typ != "" && header.typ != "" && header.typ != p.typ {
+				return "", nil, true, fmt.Errorf("column prefix declares %s metric, but query header declares %s", p.typ, header.typ)
+			}
+
+			if p.typ != "" {
+				o.typ = p.typ
+			}
+		}
+
+		if o.typ == "" {
+			o.typ = gaugeType
+		}
+
+		if o.typ == histogramType && len(o.buckets) == 0 {
+			return "", nil, true, fmt.Errorf("histogram %s requires BUCKETS in query header", name)
+		}
+
+		if o.typ != histogramType && len(o.buckets) > 0 {
+			return "", nil, true, fmt.Errorf("BUCKETS are declared for %s metric %s", o.typ, name)
+		}
+
+		if o.typ != summaryType && len(o.quantiles) > 0 {
+			return "", nil, true, fmt.Errorf("QUANTILES are declared for %s metric %s", o.typ, name)
+		}
+
+		if o.typ == summaryType && len(o.quantiles) == 0 {
+			o.quantiles = defaultQuantiles
+		}
+
+		return name, &o, true, nil
+	}
+
+	return "", nil, false, nil
+}
+
+func (set *metricSet) family(name string, query string, column string, options *metricOptions, labels []string) (*family, error) {
+	f, ok := set.families[name]
+	if !ok {
+		f = &family{
+			name:         name,
+			typ:          options.typ,
+			buckets:      options.buckets,
+			quantiles:    options.quantiles,
+			queryLabels:  map[string][]string{},
+			queryColumns: map[string]string{},
+		}
+
+		set.families[name] = f
+		set.order = append(set.order, name)
+	}
+
+	if f.typ != options.typ {
+		return nil, fmt.Errorf("metric %s is %s in query %s, but %s in query %s", name, f.typ, f.queries[0], options.typ, query)
+	}
+
+	if !equalBounds(f.buckets, options.buckets) || !equalBounds(f.quantiles, options.quantiles) {
+		return nil, fmt.Errorf("metric %s has different buckets or quantiles in queries %s and %s", name, f.queries[0], query)
+	}
+
+	f.addQuery(query)
+	for _, label := range labels {
+		f.addLabel(label)
+	}
+	f.queryLabels[query] = labels
+	f.queryColumns[query] = column
+
+	return f, nil
+}
+
+// merge adds metrics of a query computed into a separate set,
+// e.g. when results of the query are loaded from cache
+func (set *metricSet) merge(other *metricSet, query string) error {
+	for _, name := range other.order {
+		f := other.families[name]
+		column := f.queryColumns[query]
+
+		options := &metricOptions{
+			typ:       f.typ,
+			buckets:   f.buckets,
+			quantiles: f.quantiles,
+		}
+
+		target, err := set.family(name, query, column, options, f.queryLabels[query])
+		if err != nil {
+			return &columnError{column, err}
+		}
+
+		target.samples = append(target.samples, f.samples...)
+	}
+
+	return nil
+}
+
+func equalBounds(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *family) addQuery(query string) {
+	for _, q := range f.queries {
+		if q == query {
+			return
+		}
+	}
+
+	f.queries = append(f.queries, query)
+}
+
+func (f *family) addLabel(label string) {
+	for _, l := range f.labels {
+		if l == label {
+			return
+		}
+	}
+
+	f.labels = append(f.labels, label)
+}
+
+// Labels missing in a sample are exported as empty,
+// which Prometheus treats the same as an absent label
+func (f *family) labelValues(s *sample) []string {
+	values := make([]string, len(f.labels))
+
+	for i, label := range f.labels {
+		values[i] = s.labels[label]
+	}
+
+	return values
+}
+
+// conflicts returns samples with identical label values coming from
+// different queries. Such samples are allowed within one query, with the
+// last row winning, but there is no way to tell which query is correct
+func (set *metricSet) conflicts() []*conflictError {
+	conflicts := make([]*conflictError, 0)
+
+	for _, name := range set.order {
+		f := set.families[name]
+		origins := map[string]string{}
+
+		for i := range f.samples {
+			s := &f.samples[i]
+			values := f.labelValues(s)
+
+			key := strings.Join(values, "\xff")
+			if query, ok := origins[key]; ok && query != s.query {
+				conflicts = append(conflicts, &conflictError{
+					metric:  name,
+					queries: [2]string{query, s.query},
+					labels:  formatLabels(f.labels, values),
+				})
+				continue
+			}
+			origins[key] = s.query
+		}
+	}
+
+	return conflicts
+}
+
+// register exports all metric families to the registry.
+// A gauge or counter series can have only one sample in exposition, so if
+// a query produces several samples with the same labels, the one with the
+// latest timestamp is exported, or the last one if samples have no timestamps.
+// Samples of histograms and summaries are observations, each row is observed
+// in the series with its labels
+func (set *metricSet) register(registry *prometheus.Registry) error {
+	if conflicts := set.conflicts(); len(conflicts) > 0 {
+		return conflicts[0]
+	}
+
+	c := &constCollector{}
+
+	for _, name := range set.order {
+		f := set.families[name]
+		desc := prometheus.NewDesc(name, "", f.labels, nil)
+		c.descs = append(c.descs, desc)
+
+		series := map[string][]*sample{}
+		keys := make([]string, 0)
+
+		for i := range f.samples {
+			s := &f.samples[i]
+			key := strings.Join(f.labelValues(s), "\xff")
+
+			if _, ok := series[key]; !ok {
+				keys = append(keys, key)
+			}
+			series[key] = append(series[key], s)
+		}
+
+		for _, key := range keys {
+			metric, err := f.metric(desc, series[key])
+			if err != nil {
+				return fmt.Errorf("metric %s: %w", name, err)
+			}
+
+			c.metrics = append(c.metrics, metric)
+		}
+	}
+
+	return registry.Register(c)
+}
+
+// Builds a single series from samples with identical labels
+func (f *family) metric(desc *prometheus.Desc, samples []*sample) (prometheus.Metric, error) {
+	latest := samples[0]
+	for _, s := range samples[1:] {
+		if !s.timestamp.Before(latest.timestamp) {
+			latest = s
+		}
+	}
+
+	labelValues := f.labelValues(latest)
+
+	var metric prometheus.Metric
+	var err error
+
+	switch f.typ {
+	case counterType:
+		metric, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, latest.value, labelValues...)
+
+	case histogramType:
+		sum := 0.0
+		buckets := make(map[float64]uint64, len(f.buckets))
+		for _, bound := range f.buckets {
+			buckets[bound] = 0
+		}
+
+		for _, s := range samples {
+			sum += s.value
+
+			for _, bound := range f.buckets {
+				if s.value <= bound {
+					buckets[bound]++
+				}
+			}
+		}
+
+		metric, err = prometheus.NewConstHistogram(desc, uint64(len(samples)), sum, buckets, labelValues...)
+
+	case summaryType:
+		sum := 0.0
+		values := make([]float64, len(samples))
+
+		for i, s := range samples {
+			sum += s.value
+			values[i] = s.value
+		}
+		sort.Float64s(values)
+
+		quantiles := make(map[float64]float64, len(f.quantiles))
+		for _, q := range f.quantiles {
+			quantiles[q] = quantile(values, q)
+		}
+
+		metric, err = prometheus.NewConstSummary(desc, uint64(len(samples)), sum, quantiles, labelValues...)
+
+	default:
+		metric, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, latest.value, labelValues...)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !latest.timestamp.IsZero() {
+		metric = prometheus.NewMetricWithTimestamp(latest.timestamp, metric)
+	}
+
+	return metric, nil
+}
+
+// Nearest-rank quantile of sorted values, summaries are computed
+// over all rows of a query, so there is no need to approximate
+func quantile(values []float64, q float64) float64 {
+	rank := int(math.Ceil(q*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return values[rank]
+}
+
+// constCollector exports samples computed by queries as is
+type constCollector struct {
+	descs   []*prometheus.Desc
+	metrics []prometheus.Metric
+}
+
+// Describe implements prometheus.Collector.
+func (c *constCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *constCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, metric := range c.metrics {
+		ch <- metric
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	pairs := make([]string, 0, len(names))
+
+	for i := range names {
+		if values[i] != "" {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], values[i]))
+		}
+	}
+	sort.Strings(pairs)
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
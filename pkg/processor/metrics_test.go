@@ -0,0 +1,169 @@
+package processor
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Builds the set of a single query with one metric, as if it was computed
+func testQuerySet(t *testing.T, query string, options *metricOptions, labels []string, samples ...map[string]string) *metricSet {
+	t.Helper()
+
+	set := newMetricSet()
+	f, err := set.family("aws_report_cost", query, "metric_cost", options, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, l := range samples {
+		f.samples = append(f.samples, sample{query: query, labels: l, value: float64(i)})
+	}
+
+	return set
+}
+
+func TestMergeLabels(t *testing.T) {
+	gauge := &metricOptions{typ: gaugeType}
+
+	set := newMetricSet()
+	for _, qset := range []*metricSet{
+		testQuerySet(t, "a", gauge, []string{"account"}, map[string]string{"account": "1"}),
+		testQuerySet(t, "b", gauge, []string{"region", "account"}, map[string]string{"account": "1", "region": "us-east-1"}),
+	} {
+		if err := set.merge(qset, qset.families["aws_report_cost"].queries[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := set.families["aws_report_cost"]
+	if !reflect.DeepEqual(f.labels, []string{"account", "region"}) {
+		t.Errorf("merged labels = %v, expected [account region]", f.labels)
+	}
+	if !reflect.DeepEqual(f.queries, []string{"a", "b"}) {
+		t.Errorf("merged queries = %v, expected [a b]", f.queries)
+	}
+	if len(f.samples) != 2 {
+		t.Errorf("merged %d samples, expected 2", len(f.samples))
+	}
+}
+
+func TestMergeMismatch(t *testing.T) {
+	cases := []struct {
+		name   string
+		first  *metricOptions
+		second *metricOptions
+	}{
+		{"type", &metricOptions{typ: gaugeType}, &metricOptions{typ: counterType}},
+		{"buckets", &metricOptions{typ: histogramType, buckets: []float64{1, 10}}, &metricOptions{typ: histogramType, buckets: []float64{1, 100}}},
+		{"quantiles", &metricOptions{typ: summaryType, quantiles: []float64{0.5}}, &metricOptions{typ: summaryType, quantiles: []float64{0.5, 0.9}}},
+	}
+
+	for _, c := range cases {
+		set := newMetricSet()
+		if err := set.merge(testQuerySet(t, "a", c.first, nil), "a"); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		err := set.merge(testQuerySet(t, "b", c.second, nil), "b")
+
+		var columnErr *columnError
+		if !errors.As(err, &columnErr) || columnErr.column != "metric_cost" {
+			t.Errorf("%s: merge() = %v, expected error of column metric_cost", c.name, err)
+		}
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	metrics := map[string]bool{
+		"aws_report_cost": true,
+		"aws report cost": false,
+		"aws/report":      false,
+	}
+
+	for name, expected := range metrics {
+		if actual := validateMetricName(name) == nil; actual != expected {
+			t.Errorf("validateMetricName(%q) = %v, expected %v", name, actual, expected)
+		}
+	}
+
+	labels := map[string]bool{
+		"account":              true,
+		"lineItem/ProductCode": false,
+		"__name__":             false,
+		"":                     false,
+	}
+
+	for name, expected := range labels {
+		if actual := validateLabelName(name) == nil; actual != expected {
+			t.Errorf("validateLabelName(%q) = %v, expected %v", name, actual, expected)
+		}
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	type query struct {
+		name    string
+		labels  []string
+		samples []map[string]string
+	}
+
+	cases := []struct {
+		name      string
+		queries   []query
+		conflicts []string
+	}{
+		{
+			"distinct labels",
+			[]query{
+				{"a", []string{"account"}, []map[string]string{{"account": "1"}}},
+				{"b", []string{"account"}, []map[string]string{{"account": "2"}}},
+			},
+			nil,
+		},
+		{
+			"duplicates within query",
+			[]query{
+				{"a", []string{"account"}, []map[string]string{{"account": "1"}, {"account": "1"}}},
+			},
+			nil,
+		},
+		{
+			"identical labels",
+			[]query{
+				{"a", []string{"account"}, []map[string]string{{"account": "1"}, {"account": "2"}}},
+				{"b", []string{"account"}, []map[string]string{{"account": "2"}}},
+			},
+			[]string{`a b {account="2"}`},
+		},
+		{
+			"label missing in query",
+			[]query{
+				{"a", []string{"account"}, []map[string]string{{"account": "1"}}},
+				{"b", []string{"account", "region"}, []map[string]string{{"account": "1", "region": ""}, {"account": "1", "region": "us-east-1"}}},
+			},
+			[]string{`a b {account="1"}`},
+		},
+	}
+
+	for _, c := range cases {
+		set := newMetricSet()
+		for _, q := range c.queries {
+			if err := set.merge(testQuerySet(t, q.name, &metricOptions{typ: gaugeType}, q.labels, q.samples...), q.name); err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+		}
+
+		var conflicts []string
+		for _, conflict := range set.conflicts() {
+			if conflict.metric != "aws_report_cost" {
+				t.Errorf("%s: conflict of metric %s", c.name, conflict.metric)
+			}
+			conflicts = append(conflicts, conflict.queries[0]+" "+conflict.queries[1]+" "+conflict.labels)
+		}
+
+		if !reflect.DeepEqual(conflicts, c.conflicts) {
+			t.Errorf("%s: conflicts() = %q, expected %q", c.name, conflicts, c.conflicts)
+		}
+	}
+}
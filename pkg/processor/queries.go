@@ -0,0 +1,208 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+type Query struct {
+	Name string
+	Text string
+}
+
+// LoadQueries reads all query files from queries directory.
+// Hidden entries are skipped, so a Kubernetes ConfigMap
+// can be mounted as queries directory
+func LoadQueries(config *state.Config) ([]Query, error) {
+	items, err := os.ReadDir(config.QueriesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	queries := make([]Query, 0, len(items))
+
+	for _, item := range items {
+		if item.IsDir() || strings.HasPrefix(item.Name(), ".") {
+			continue
+		}
+
+		text, err := os.ReadFile(filepath.Join(config.QueriesPath, item.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(strings.TrimSpace(string(text))) == 0 {
+			return nil, fmt.Errorf("query %s: file is empty", item.Name())
+		}
+
+		queries = append(queries, Query{
+			Name: item.Name(),
+			Text: string(text),
+		})
+	}
+
+	return queries, nil
+}
+
+// metricOptions are declared in the query header with comments
+// similar to metadata lines of Prometheus text format:
+//
+//	-- TYPE aws_report_cost counter
+//	-- BUCKETS aws_report_resource_cost 1,10,100,1000
+//	-- QUANTILES aws_report_resource_cost 0.5,0.9,0.99
+type metricOptions struct {
+	typ       metricType
+	buckets   []float64
+	quantiles []float64
+}
+
+// queryHeader holds settings declared in leading comments of the query
+type queryHeader struct {
+	metrics map[string]*metricOptions
+
+	// Maximum age of cached results, declared as
+	//
+	//	-- REFRESH 24h
+	//
+	// Results are reused until inputs of the query change if zero
+	refresh time.Duration
+}
+
+// headerError points to the line of query header which caused an error
+type headerError struct {
+	line int
+	err  error
+}
+
+func (e *headerError) Error() string {
+	return fmt.Sprintf("header line %d: %s", e.line, e.err)
+}
+
+func (e *headerError) Unwrap() error {
+	return e.err
+}
+
+// parseHeader reads settings from leading comments of the query,
+// comments which are not directives are ignored
+func parseHeader(text string) (*queryHeader, error) {
+	header := &queryHeader{
+		metrics: map[string]*metricOptions{},
+	}
+
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(line, "--"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		directive := fields[0]
+
+		if directive == "REFRESH" {
+			if len(fields) != 2 {
+				return nil, &headerError{i + 1, fmt.Errorf("expected REFRESH <duration>")}
+			}
+
+			refresh, err := time.ParseDuration(fields[1])
+			if err != nil || refresh <= 0 {
+				return nil, &headerError{i + 1, fmt.Errorf("REFRESH: invalid duration: %s", fields[1])}
+			}
+
+			header.refresh = refresh
+			continue
+		}
+
+		if directive != "TYPE" && directive != "BUCKETS" && directive != "QUANTILES" {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, &headerError{i + 1, fmt.Errorf("expected %s <metric> <value>", directive)}
+		}
+
+		name := fields[1]
+		if err := validateMetricName(name); err != nil {
+			return nil, &headerError{i + 1, err}
+		}
+
+		o, ok := header.metrics[name]
+		if !ok {
+			o = &metricOptions{}
+			header.metrics[name] = o
+		}
+
+		var err error
+
+		switch directive {
+		case "TYPE":
+			o.typ, err = parseMetricType(fields[2])
+		case "BUCKETS":
+			o.buckets, err = parseBounds(fields[2], false)
+		case "QUANTILES":
+			o.quantiles, err = parseBounds(fields[2], true)
+		}
+
+		if err != nil {
+			return nil, &headerError{i + 1, fmt.Errorf("%s %s: %w", directive, name, err)}
+		}
+	}
+
+	return header, nil
+}
+
+func parseMetricType(value string) (metricType, error) {
+	switch t := metricType(value); t {
+	case gaugeType, counterType, histogramType, summaryType:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown metric type: %s", value)
+	}
+}
+
+// Parses comma-separated list of increasing numbers,
+// quantiles must additionally lie between 0 and 1
+func parseBounds(value string, quantiles bool) ([]float64, error) {
+	bounds := make([]float64, 0)
+
+	for _, field := range strings.Split(value, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %q", field)
+		}
+
+		if math.IsInf(bound, 1) && !quantiles {
+			continue
+		}
+
+		if quantiles && (bound <= 0 || bound >= 1) {
+			return nil, fmt.Errorf("quantile must be between 0 and 1: %s", field)
+		}
+
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("values must be in increasing order: %s", value)
+		}
+
+		bounds = append(bounds, bound)
+	}
+
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("no values")
+	}
+
+	return bounds, nil
+}
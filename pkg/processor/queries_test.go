@@ -0,0 +1,157 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHeaderRefresh(t *testing.T) {
+	cases := []struct {
+		text    string
+		refresh time.Duration
+		err     bool
+	}{
+		{"select 1", 0, false},
+		{"-- REFRESH 24h\nselect 1", 24 * time.Hour, false},
+		{"-- comment\n\n-- REFRESH 90m\nselect 1", 90 * time.Minute, false},
+		{"select 1\n-- REFRESH 1h", 0, false},
+		{"-- REFRESH\nselect 1", 0, true},
+		{"-- REFRESH 1h 2h\nselect 1", 0, true},
+		{"-- REFRESH daily\nselect 1", 0, true},
+		{"-- REFRESH 0s\nselect 1", 0, true},
+		{"-- REFRESH -1h\nselect 1", 0, true},
+	}
+
+	for _, c := range cases {
+		header, err := parseHeader(c.text)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseHeader(%q) succeeded, expected error", c.text)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseHeader(%q): %v", c.text, err)
+			continue
+		}
+
+		if header.refresh != c.refresh {
+			t.Errorf("parseHeader(%q) refresh = %v, expected %v", c.text, header.refresh, c.refresh)
+		}
+	}
+}
+
+func TestParseHeaderMetrics(t *testing.T) {
+	cases := []struct {
+		text    string
+		metrics map[string]*metricOptions
+		err     bool
+	}{
+		{"select 1", map[string]*metricOptions{}, false},
+		{
+			"-- TYPE aws_report_cost counter\nselect 1",
+			map[string]*metricOptions{"aws_report_cost": {typ: counterType}},
+			false,
+		},
+		{
+			"-- TYPE aws_report_cost histogram\n-- BUCKETS aws_report_cost 0.1,1,10,+Inf\n-- Not a directive\nselect 1",
+			map[string]*metricOptions{"aws_report_cost": {typ: histogramType, buckets: []float64{0.1, 1, 10}}},
+			false,
+		},
+		{
+			"-- QUANTILES aws_report_cost 0.5,0.99\nselect 1",
+			map[string]*metricOptions{"aws_report_cost": {quantiles: []float64{0.5, 0.99}}},
+			false,
+		},
+		{"-- TYPE aws_report_cost\nselect 1", nil, true},
+		{"-- TYPE aws_report_cost untyped\nselect 1", nil, true},
+		{"-- TYPE 1cost gauge\nselect 1", nil, true},
+		{"-- BUCKETS aws_report_cost 10,1\nselect 1", nil, true},
+		{"-- BUCKETS aws_report_cost 1,1\nselect 1", nil, true},
+		{"-- BUCKETS aws_report_cost +Inf\nselect 1", nil, true},
+		{"-- BUCKETS aws_report_cost one\nselect 1", nil, true},
+		{"-- QUANTILES aws_report_cost 0.5,1\nselect 1", nil, true},
+		{"-- QUANTILES aws_report_cost 0\nselect 1", nil, true},
+	}
+
+	for _, c := range cases {
+		header, err := parseHeader(c.text)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseHeader(%q) succeeded, expected error", c.text)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parseHeader(%q): %v", c.text, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(header.metrics, c.metrics) {
+			t.Errorf("parseHeader(%q) metrics = %v, expected %v", c.text, header.metrics, c.metrics)
+		}
+	}
+}
+
+func TestColumnOptions(t *testing.T) {
+	header := map[string]*metricOptions{
+		"aws_report_typed":     {typ: counterType},
+		"aws_report_histogram": {typ: histogramType, buckets: []float64{1, 10}},
+		"aws_report_buckets":   {buckets: []float64{1, 10}},
+		"aws_report_quantiles": {quantiles: []float64{0.5}},
+	}
+
+	cases := []struct {
+		column string
+		name   string
+		typ    metricType
+		metric bool
+		err    bool
+	}{
+		{"product", "", "", false, false},
+		{"metric_cost", "aws_report_cost", gaugeType, true, false},
+		{"gauge_cost", "aws_report_cost", gaugeType, true, false},
+		{"counter_cost", "aws_report_cost", counterType, true, false},
+		{"summary_cost", "aws_report_cost", summaryType, true, false},
+		{"metric_typed", "aws_report_typed", counterType, true, false},
+		{"counter_typed", "aws_report_typed", counterType, true, false},
+		{"gauge_typed", "", "", true, true},
+		{"metric_histogram", "aws_report_histogram", histogramType, true, false},
+		{"histogram_buckets", "aws_report_buckets", histogramType, true, false},
+		{"histogram_cost", "", "", true, true},
+		{"metric_buckets", "", "", true, true},
+		{"metric_quantiles", "", "", true, true},
+		{"summary_quantiles", "aws_report_quantiles", summaryType, true, false},
+		{"metric_cost-usd", "", "", true, true},
+	}
+
+	for _, c := range cases {
+		name, options, metric, err := columnOptions(c.column, header)
+		if metric != c.metric {
+			t.Errorf("columnOptions(%q) marks metric %v, expected %v", c.column, metric, c.metric)
+		}
+
+		if c.err {
+			if err == nil {
+				t.Errorf("columnOptions(%q) succeeded, expected error", c.column)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("columnOptions(%q): %v", c.column, err)
+			continue
+		}
+
+		if !c.metric {
+			continue
+		}
+
+		if name != c.name || options.typ != c.typ {
+			t.Errorf("columnOptions(%q) = %s %s, expected %s %s", c.column, name, options.typ, c.name, c.typ)
+		}
+	}
+}
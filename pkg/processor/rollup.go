@@ -0,0 +1,359 @@
+package processor
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Dimension of rollups holding date of lineItem/UsageStartDate
+const rollupDayDimension = "day"
+
+// Columns summed by rollups if present in the report,
+// rollups keep names of report columns so queries look the same
+var rollupMeasures = []string{
+	"lineItem/UsageAmount",
+	"lineItem/NormalizedUsageAmount",
+	"lineItem/UnblendedCost",
+	"lineItem/BlendedCost",
+	"lineItem/NetUnblendedCost",
+	"pricing/publicOnDemandCost",
+	"reservation/EffectiveCost",
+	"savingsPlan/SavingsPlanEffectiveCost",
+}
+
+// Column of rollups with number of aggregated line items
+const rollupCountColumn = "lineItems"
+
+var rollupName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// ValidateRollup checks name and dimensions of rollup definition
+func ValidateRollup(name string, dimensions []string) error {
+	if !rollupName.MatchString(name) {
+		return fmt.Errorf("invalid rollup name %q, only lowercase letters, digits and underscores are allowed", name)
+	}
+
+	if len(dimensions) == 0 {
+		return fmt.Errorf("rollup %s has no dimensions", name)
+	}
+
+	seen := map[string]bool{}
+
+	for _, dimension := range dimensions {
+		if dimension == "" {
+			return fmt.Errorf("rollup %s has empty dimension", name)
+		}
+
+		if seen[dimension] {
+			return fmt.Errorf("rollup %s has duplicate dimension %s", name, dimension)
+		}
+		seen[dimension] = true
+
+		// Rollup columns would be ambiguous
+		if dimension == rollupCountColumn || isRollupMeasure(dimension) {
+			return fmt.Errorf("rollup %s has dimension %s, which is a column with sums of line items", name, dimension)
+		}
+	}
+
+	return nil
+}
+
+func isRollupMeasure(column string) bool {
+	for _, measure := range rollupMeasures {
+		if column == measure {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rollup files are named after the report and the definition,
+// so they are rebuilt when dimensions change
+func rollupFile(name string, dimensions []string, report string) string {
+	digest := sha256.Sum256([]byte(strings.Join(dimensions, "\x00")))
+
+	return fmt.Sprintf("%s.%s.%s.csv", strings.TrimSuffix(report, ".csv"), name, hex.EncodeToString(digest[:])[:8])
+}
+
+// Lists rollup tables in the same order as report tables, e.g.
+// rollup-daily-current.csv, rollup-daily-1.csv, ...
+func rollupTables(config *state.Config) ([]reportTable, error) {
+	reports, err := reportTables(config)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(config.Rollups))
+	for name := range config.Rollups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tables := make([]reportTable, 0)
+
+	for _, name := range names {
+		for _, report := range reports {
+			if !strings.HasSuffix(report.File, ".csv") {
+				continue
+			}
+
+			tables = append(tables, reportTable{
+				Table: "rollup-" + name + "-" + strings.TrimPrefix(report.Table, "report-"),
+				File:  rollupFile(name, config.Rollups[name], report.File),
+			})
+		}
+	}
+
+	return tables, nil
+}
+
+// UpdateRollups builds configured rollups of reports which don't have
+// them yet or were downloaded again, and removes rollups of other reports
+func UpdateRollups(config *state.Config, logger log.Logger) error {
+	dataDir := filepath.Join(config.RepositoryPath, "data")
+	rollupsDir := filepath.Join(config.RepositoryPath, "rollups")
+
+	if len(config.Rollups) == 0 {
+		return os.RemoveAll(rollupsDir)
+	}
+
+	if err := os.MkdirAll(rollupsDir, 0750); err != nil {
+		return err
+	}
+
+	items, err := os.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]bool{}
+
+	for _, item := range items {
+		if item.IsDir() || !strings.HasSuffix(item.Name(), ".csv") {
+			continue
+		}
+
+		info, err := item.Info()
+		if err != nil {
+			return err
+		}
+
+		pending := map[string][]string{}
+
+		for name, dimensions := range config.Rollups {
+			file := rollupFile(name, dimensions, item.Name())
+			wanted[file] = true
+
+			rollupInfo, err := os.Stat(filepath.Join(rollupsDir, file))
+			if err == nil && !rollupInfo.ModTime().Before(info.ModTime()) {
+				continue
+			} else if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			pending[file] = dimensions
+		}
+
+		if len(pending) == 0 {
+			continue
+		}
+
+		start := time.Now()
+		level.Info(logger).Log("msg", "Building rollups", "report", item.Name(), "rollups", len(pending))
+
+		if err := buildRollups(filepath.Join(dataDir, item.Name()), rollupsDir, pending, logger); err != nil {
+			return fmt.Errorf("report %s: %w", item.Name(), err)
+		}
+
+		level.Info(logger).Log("msg", "Built rollups", "report", item.Name(), "duration", time.Since(start))
+	}
+
+	rollups, err := os.ReadDir(rollupsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range rollups {
+		if !wanted[item.Name()] {
+			if err := os.RemoveAll(filepath.Join(rollupsDir, item.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type rollupGroup struct {
+	dimensions []string
+	sums       []float64
+	count      int
+}
+
+// buildRollups aggregates the report into several rollups in a single pass.
+// Columns of reports change over time, e.g. when a cost allocation tag is
+// activated, so dimensions missing in the report are empty with a warning
+func buildRollups(report string, dir string, rollups map[string][]string, logger log.Logger) error {
+	f, err := os.Open(report)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReaderSize(f, 1<<20))
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+
+	positions := make(map[string]int, len(header))
+	for i, column := range header {
+		positions[column] = i
+	}
+
+	measures := make([]string, 0)
+	measureColumns := make([]int, 0)
+	for _, measure := range rollupMeasures {
+		if i, ok := positions[measure]; ok {
+			measures = append(measures, measure)
+			measureColumns = append(measureColumns, i)
+		}
+	}
+
+	files := make([]string, 0, len(rollups))
+	for file := range rollups {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	groups := make([]map[string]*rollupGroup, len(files))
+	for i, file := range files {
+		groups[i] = map[string]*rollupGroup{}
+
+		for _, dimension := range rollups[file] {
+			column := dimension
+			if dimension == rollupDayDimension {
+				column = "lineItem/UsageStartDate"
+			}
+
+			if _, ok := positions[column]; !ok {
+				level.Warn(logger).Log("msg", "Rollup dimension is missing in report, its values are empty", "report", filepath.Base(report), "rollup", file, "dimension", dimension)
+			}
+		}
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		for i, file := range files {
+			dimensions := make([]string, len(rollups[file]))
+
+			for j, dimension := range rollups[file] {
+				if dimension == rollupDayDimension {
+					if p, ok := positions["lineItem/UsageStartDate"]; ok && len(record[p]) >= 10 {
+						dimensions[j] = record[p][:10]
+					}
+				} else if p, ok := positions[dimension]; ok {
+					dimensions[j] = record[p]
+				}
+			}
+
+			key := strings.Join(dimensions, "\xff")
+
+			g, ok := groups[i][key]
+			if !ok {
+				g = &rollupGroup{dimensions: dimensions, sums: make([]float64, len(measures))}
+				groups[i][key] = g
+			}
+
+			for j, column := range measureColumns {
+				if value, err := strconv.ParseFloat(record[column], 64); err == nil {
+					g.sums[j] += value
+				}
+			}
+			g.count++
+		}
+	}
+
+	for i, file := range files {
+		if err := writeRollup(filepath.Join(dir, file), rollups[file], measures, groups[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeRollup(file string, dimensions []string, measures []string, groups map[string]*rollupGroup) error {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file + ".tmp")
+
+	w := csv.NewWriter(f)
+
+	header := append(append(append([]string(nil), dimensions...), measures...), rollupCountColumn)
+	if err := w.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+
+	record := make([]string, len(header))
+
+	for _, key := range keys {
+		g := groups[key]
+
+		copy(record, g.dimensions)
+		for i, sum := range g.sums {
+			record[len(dimensions)+i] = strconv.FormatFloat(sum, 'g', -1, 64)
+		}
+		record[len(header)-1] = strconv.Itoa(g.count)
+
+		if err := w.Write(record); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
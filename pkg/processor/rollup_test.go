@@ -0,0 +1,92 @@
+package processor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestValidateRollup(t *testing.T) {
+	cases := []struct {
+		name       string
+		dimensions []string
+		valid      bool
+	}{
+		{"daily", []string{"day", "product/ProductName"}, true},
+		{"by_team", []string{"resourceTags/user:team"}, true},
+		{"Daily", []string{"day"}, false},
+		{"daily", nil, false},
+		{"daily", []string{"day", ""}, false},
+		{"daily", []string{"day", "day"}, false},
+		{"daily", []string{"day", "lineItem/UnblendedCost"}, false},
+		{"daily", []string{"day", "lineItems"}, false},
+	}
+
+	for _, c := range cases {
+		err := ValidateRollup(c.name, c.dimensions)
+		if (err == nil) != c.valid {
+			t.Errorf("ValidateRollup(%q, %q) = %v, expected valid %v", c.name, c.dimensions, err, c.valid)
+		}
+	}
+}
+
+func TestBuildRollups(t *testing.T) {
+	cases := []struct {
+		dimensions []string
+		expected   string
+		missing    bool
+	}{
+		{
+			[]string{"day"},
+			"day,lineItem/UsageAmount,lineItem/UnblendedCost,lineItems\n" +
+				"2023-10-01,3.5,1.75,2\n" +
+				"2023-10-02,3,0.01,1\n",
+			false,
+		},
+		{
+			[]string{"product/ProductName", "lineItem/UsageAccountId"},
+			"product/ProductName,lineItem/UsageAccountId,lineItem/UsageAmount,lineItem/UnblendedCost,lineItems\n" +
+				"Amazon Elastic Compute Cloud,222222222222,4,0.51,2\n" +
+				"Amazon Simple Storage Service,012345678901,2.5,1.25,1\n",
+			false,
+		},
+		{
+			[]string{"resourceTags/user:team", "day"},
+			"resourceTags/user:team,day,lineItem/UsageAmount,lineItem/UnblendedCost,lineItems\n" +
+				",2023-10-01,3.5,1.75,2\n" +
+				",2023-10-02,3,0.01,1\n",
+			true,
+		},
+	}
+
+	repository := writeTestReport(t)
+	report := filepath.Join(repository, "data", "20231001-test.csv")
+
+	for _, c := range cases {
+		dir := t.TempDir()
+		var logs bytes.Buffer
+
+		if err := buildRollups(report, dir, map[string][]string{"rollup.csv": c.dimensions}, log.NewLogfmtLogger(&logs)); err != nil {
+			t.Errorf("%q: %v", c.dimensions, err)
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, "rollup.csv"))
+		if err != nil {
+			t.Errorf("%q: %v", c.dimensions, err)
+			continue
+		}
+
+		if string(data) != c.expected {
+			t.Errorf("%q: rollup %q, expected %q", c.dimensions, data, c.expected)
+		}
+
+		if warned := strings.Contains(logs.String(), "dimension=resourceTags/user:team"); warned != c.missing {
+			t.Errorf("%q: logged %q, expected warning %v", c.dimensions, logs.String(), c.missing)
+		}
+	}
+}
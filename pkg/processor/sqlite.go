@@ -0,0 +1,486 @@
+package processor
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Columns of report tables which are indexed if present,
+// queries usually filter line items by usage time
+var sqliteIndexedColumns = []string{
+	"lineItem/UsageStartDate",
+}
+
+// Version of table layout in the database, increment it
+// whenever types of imported columns change
+const sqliteSchemaVersion = 2
+
+// Columns of costs and usage amounts, which are stored as numbers if all
+// their values are numeric. Other columns are text even if they look
+// numeric, e.g. account IDs, so labels are the same as with csvq
+var sqliteNumericColumn = regexp.MustCompile(`^([A-Za-z]+/[A-Za-z]*(Amount|Cost|Rate|Fee|Factor|Units|Quantity)[A-Za-z]*|` + rollupCountColumn + `)$`)
+
+// Suffixes of columns matching sqliteNumericColumn which hold identifiers, e.g. pricing/RateId
+var sqliteTextColumn = regexp.MustCompile(`(Id|Code|Type|Description|Name)$`)
+
+// openSQLite imports reports and rollups of the repository into SQLite database
+// in cache directory, each file is imported only once. Tables of
+// reports are exposed as views with the same names as csvq tables,
+// so queries written in common SQL work with both engines
+func openSQLite(config *state.Config, logger log.Logger) (*sql.DB, error) {
+	cacheDir := filepath.Join(config.RepositoryPath, "cache")
+	if err := os.MkdirAll(cacheDir, 0750); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(cacheDir, "reports.sqlite")+"?_busy_timeout=60000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := updateSQLite(db, config, logger); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	level.Debug(logger).Log("msg", "Opened database", "engine", EngineSQLite, "repository", config.RepositoryPath)
+
+	return db, nil
+}
+
+func updateSQLite(db *sql.DB, config *state.Config, logger log.Logger) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	// Files imported with older layout of tables are imported again
+	if version != sqliteSchemaVersion {
+		if _, err := db.Exec(`DROP TABLE IF EXISTS _reports`); err != nil {
+			return err
+		}
+
+		if _, err := db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, sqliteSchemaVersion)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS _reports (name TEXT PRIMARY KEY, size INTEGER, mod_time INTEGER)`); err != nil {
+		return err
+	}
+
+	imported := map[string]bool{}
+
+	// Tables are named after files relative to the repository, e.g. data/20231001-abc.csv
+	for _, dir := range []string{"data", "rollups"} {
+		items, err := os.ReadDir(filepath.Join(config.RepositoryPath, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			if item.IsDir() || !strings.HasSuffix(item.Name(), ".csv") {
+				continue
+			}
+
+			info, err := item.Info()
+			if err != nil {
+				return err
+			}
+
+			name := dir + "/" + item.Name()
+
+			var size, modTime int64
+			err = db.QueryRow(`SELECT size, mod_time FROM _reports WHERE name = ?`, name).Scan(&size, &modTime)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+
+			if err == sql.ErrNoRows || size != info.Size() || modTime != info.ModTime().UnixNano() {
+				start := time.Now()
+				level.Info(logger).Log("msg", "Importing file into SQLite database", "file", name)
+
+				if err := importSQLite(db, filepath.Join(config.RepositoryPath, name), name, info); err != nil {
+					return fmt.Errorf("file %s: %w", name, err)
+				}
+
+				level.Info(logger).Log("msg", "Imported file", "file", name, "duration", time.Since(start))
+			}
+
+			imported[name] = true
+		}
+	}
+
+	// Forget reports which were removed from the repository
+	rows, err := db.Query(`SELECT name FROM _reports`)
+	if err != nil {
+		return err
+	}
+
+	removed := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if !imported[name] {
+			removed = append(removed, name)
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range removed {
+		if _, err := db.Exec(`DROP TABLE IF EXISTS ` + quoteIdentifier(name)); err != nil {
+			return err
+		}
+
+		if _, err := db.Exec(`DELETE FROM _reports WHERE name = ?`, name); err != nil {
+			return err
+		}
+	}
+
+	return updateSQLiteViews(db, config)
+}
+
+// Recreates report-current.csv, report-1.csv, ..., report-all.csv and rollup views
+func updateSQLiteViews(db *sql.DB, config *state.Config) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT name FROM sqlite_master WHERE type = 'view'`)
+	if err != nil {
+		return err
+	}
+
+	views := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		views = append(views, name)
+	}
+	rows.Close()
+
+	for _, view := range views {
+		if _, err := tx.Exec(`DROP VIEW ` + quoteIdentifier(view)); err != nil {
+			return err
+		}
+	}
+
+	tables, err := reportTables(config)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if !strings.HasSuffix(table.File, ".csv") {
+			continue
+		}
+
+		if err := createView(tx, table.Table, "SELECT * FROM "+quoteIdentifier("data/"+table.File)); err != nil {
+			return err
+		}
+	}
+
+	rollups, err := rollupTables(config)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range rollups {
+		if err := createView(tx, table.Table, "SELECT * FROM "+quoteIdentifier("rollups/"+table.File)); err != nil {
+			return err
+		}
+	}
+
+	sources, err := unionSources(config)
+	if err != nil {
+		return err
+	}
+
+	if len(sources) > 0 {
+		columns := make([]string, 0)
+		sourceColumns := make([]map[string]bool, len(sources))
+
+		for i, source := range sources {
+			sourceColumns[i] = map[string]bool{}
+
+			names, err := tableColumns(tx, "data/"+filepath.Base(source.path))
+			if err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				if !containsColumn(columns, name) {
+					columns = append(columns, name)
+				}
+				sourceColumns[i][name] = true
+			}
+		}
+
+		selects := make([]string, len(sources))
+
+		for i, source := range sources {
+			fields := []string{fmt.Sprintf("'%s' AS %s", source.period, quoteIdentifier(unionPeriodColumn))}
+
+			for _, column := range columns {
+				if sourceColumns[i][column] {
+					fields = append(fields, quoteIdentifier(column))
+				} else {
+					fields = append(fields, "NULL AS "+quoteIdentifier(column))
+				}
+			}
+
+			selects[i] = fmt.Sprintf(
+				"SELECT %s FROM %s",
+				strings.Join(fields, ", "), quoteIdentifier("data/"+filepath.Base(source.path)),
+			)
+		}
+
+		if err := createView(tx, unionTable, strings.Join(selects, " UNION ALL ")); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Creates view under table name and its name without extension,
+// as csvq resolves both report-current and report-current.csv
+func createView(tx *sql.Tx, name string, query string) error {
+	for _, view := range []string{name, strings.TrimSuffix(name, ".csv")} {
+		if _, err := tx.Exec(fmt.Sprintf(`CREATE VIEW %s AS %s`, quoteIdentifier(view), query)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func tableColumns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+
+	return columns, rows.Err()
+}
+
+func containsColumn(columns []string, column string) bool {
+	for _, c := range columns {
+		if c == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+// importSQLite loads report or rollup file into a table. Report is read twice,
+// first to find numeric columns which are stored with NUMERIC affinity, so
+// they can be compared with numbers the same way csvq does and integers stay
+// integers. Empty values become NULL
+func importSQLite(db *sql.DB, path string, name string, info os.FileInfo) error {
+	header, numeric, err := inferColumnTypes(path)
+	if err != nil {
+		return err
+	}
+
+	table := quoteIdentifier(name)
+
+	definitions := make([]string, len(header))
+	placeholders := make([]string, len(header))
+
+	for i, column := range header {
+		if numeric[i] {
+			definitions[i] = quoteIdentifier(column) + " NUMERIC"
+		} else {
+			definitions[i] = quoteIdentifier(column) + " TEXT"
+		}
+		placeholders[i] = "?"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(`CREATE TABLE %s (%s)`, table, strings.Join(definitions, ", "))); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s VALUES (%s)`, table, strings.Join(placeholders, ", ")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReaderSize(f, 1<<20))
+	r.ReuseRecord = true
+
+	if _, err := r.Read(); err != nil {
+		return err
+	}
+
+	values := make([]interface{}, len(header))
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		for i, value := range record {
+			switch {
+			case value == "":
+				values[i] = nil
+			case numeric[i]:
+				values[i], _ = strconv.ParseFloat(value, 64)
+			default:
+				values[i] = value
+			}
+		}
+
+		if _, err := stmt.Exec(values...); err != nil {
+			return err
+		}
+	}
+
+	for _, column := range sqliteIndexedColumns {
+		if !containsColumn(header, column) {
+			continue
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf(
+			`CREATE INDEX %s ON %s (%s)`,
+			quoteIdentifier(name+"/"+column), table, quoteIdentifier(column),
+		)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(
+		`INSERT OR REPLACE INTO _reports (name, size, mod_time) VALUES (?, ?, ?)`,
+		name, info.Size(), info.ModTime().UnixNano(),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// A column is numeric if it holds costs or usage amounts
+// and all its values are decimal numbers
+func inferColumnTypes(path string) ([]string, []bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReaderSize(f, 1<<20))
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	header = append([]string(nil), header...)
+
+	numeric := make([]bool, len(header))
+	for i, column := range header {
+		numeric[i] = isNumericColumn(column)
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		for i, value := range record {
+			if numeric[i] && value != "" && !isDecimal(value) {
+				numeric[i] = false
+			}
+		}
+	}
+
+	return header, numeric, nil
+}
+
+func isNumericColumn(column string) bool {
+	return sqliteNumericColumn.MatchString(column) && !sqliteTextColumn.MatchString(column)
+}
+
+func isDecimal(value string) bool {
+	digits := strings.TrimPrefix(value, "-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] != '.' {
+		return false
+	}
+
+	for _, c := range digits {
+		if (c < '0' || c > '9') && c != '.' && c != 'e' && c != 'E' && c != '-' && c != '+' {
+			return false
+		}
+	}
+
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,173 @@
+package processor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+const testReport = `identity/LineItemId,bill/PayerAccountId,lineItem/UsageAccountId,lineItem/UsageStartDate,lineItem/UsageAmount,lineItem/UnblendedCost,pricing/RateId,product/ProductName
+a,111111111111,222222222222,2023-10-01T00:00:00Z,1,0.5,100,Amazon Elastic Compute Cloud
+b,111111111111,012345678901,2023-10-01T01:00:00Z,2.5,1.25,101,Amazon Simple Storage Service
+c,111111111111,222222222222,2023-10-02T00:00:00Z,3,1e-2,100,Amazon Elastic Compute Cloud
+`
+
+func writeTestReport(t *testing.T) string {
+	t.Helper()
+
+	repository := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(repository, "data"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(repository, "data", "20231001-test.csv"), []byte(testReport), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	return repository
+}
+
+func TestIsDecimal(t *testing.T) {
+	cases := map[string]bool{
+		"0":            true,
+		"1":            true,
+		"-1.5":         true,
+		"0.25":         true,
+		"1e-2":         true,
+		"2.5E+3":       true,
+		"111111111111": true,
+		"012345678901": false,
+		"":             false,
+		"1.2.3":        false,
+		"abc":          false,
+		"0x10":         false,
+		"NaN":          false,
+		"Inf":          false,
+	}
+
+	for value, expected := range cases {
+		if actual := isDecimal(value); actual != expected {
+			t.Errorf("isDecimal(%q) = %v, expected %v", value, actual, expected)
+		}
+	}
+}
+
+func TestIsNumericColumn(t *testing.T) {
+	cases := map[string]bool{
+		"lineItem/UsageAmount":                                  true,
+		"lineItem/UnblendedCost":                                true,
+		"lineItem/UnblendedRate":                                true,
+		"lineItem/NormalizationFactor":                          true,
+		"reservation/UnusedAmortizedUpfrontFeeForBillingPeriod": true,
+		"reservation/TotalReservedUnits":                        true,
+		"lineItems":                                             true,
+		"lineItem/UsageAccountId":                               false,
+		"bill/PayerAccountId":                                   false,
+		"pricing/RateId":                                        false,
+		"pricing/RateCode":                                      false,
+		"lineItem/CurrencyCode":                                 false,
+		"product/ProductName":                                   false,
+		"day":                                                   false,
+	}
+
+	for column, expected := range cases {
+		if actual := isNumericColumn(column); actual != expected {
+			t.Errorf("isNumericColumn(%q) = %v, expected %v", column, actual, expected)
+		}
+	}
+}
+
+func TestInferColumnTypes(t *testing.T) {
+	repository := writeTestReport(t)
+
+	header, numeric, err := inferColumnTypes(filepath.Join(repository, "data", "20231001-test.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := map[string]bool{}
+	for i, column := range header {
+		types[column] = numeric[i]
+	}
+
+	expected := map[string]bool{
+		"identity/LineItemId":     false,
+		"bill/PayerAccountId":     false,
+		"lineItem/UsageAccountId": false,
+		"lineItem/UsageStartDate": false,
+		"lineItem/UsageAmount":    true,
+		"lineItem/UnblendedCost":  true,
+		"pricing/RateId":          false,
+		"product/ProductName":     false,
+	}
+
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("inferColumnTypes() = %v, expected %v", types, expected)
+	}
+}
+
+// Series must keep their identity when the query engine is switched
+func TestEnginesExportSameSeries(t *testing.T) {
+	query := Query{
+		Name: "accounts",
+		Text: "select `bill/PayerAccountId` as payer, `lineItem/UsageAccountId` as account, `pricing/RateId` as rate, " +
+			"SUM(`lineItem/UnblendedCost`) as metric_cost, SUM(`lineItem/UsageAmount`) as metric_usage " +
+			"from `report-current.csv` where `lineItem/UnblendedCost` > 0.1 " +
+			"group by `bill/PayerAccountId`, `lineItem/UsageAccountId`, `pricing/RateId`",
+	}
+
+	series := map[string][]string{}
+
+	for _, engine := range []string{EngineCSVQ, EngineSQLite} {
+		config := &state.Config{
+			RepositoryPath: writeTestReport(t),
+			QueryEngine:    engine,
+		}
+
+		db, err := Open(config, log.NewNopLogger())
+		if err != nil {
+			t.Fatalf("%s: %v", engine, err)
+		}
+
+		_, registry, err := Execute(context.Background(), db, config, query, log.NewNopLogger())
+		db.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", engine, err)
+		}
+
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("%s: %v", engine, err)
+		}
+
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				labels := make([]string, 0, len(m.Label))
+				for _, l := range m.Label {
+					labels = append(labels, l.GetName()+"="+l.GetValue())
+				}
+
+				series[engine] = append(series[engine], mf.GetName()+"{"+strings.Join(labels, ",")+"} "+strconv.FormatFloat(m.GetGauge().GetValue(), 'g', -1, 64))
+			}
+		}
+
+		sort.Strings(series[engine])
+	}
+
+	if len(series[EngineCSVQ]) == 0 {
+		t.Fatal("query exported no series")
+	}
+
+	if !reflect.DeepEqual(series[EngineCSVQ], series[EngineSQLite]) {
+		t.Errorf("engines export different series\ncsvq:   %v\nsqlite: %v", series[EngineCSVQ], series[EngineSQLite])
+	}
+}
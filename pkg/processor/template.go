@@ -0,0 +1,123 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"text/template"
+	"time"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Matches tables of previous periods, e.g. report-1.csv
+var reportTableName = regexp.MustCompile(`^report-[0-9]+\.csv$`)
+
+// reportTable is a report file exposed as csvq table
+type reportTable struct {
+	Table string
+	File  string
+}
+
+// Lists report files of the repository from the most recent period,
+// which is exposed as report-current.csv, followed by report-1.csv, ...
+// Only the latest assembly of each period is listed, like in union table
+func reportTables(config *state.Config) ([]reportTable, error) {
+	sources, err := unionSources(config)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]reportTable, len(sources))
+
+	for i, source := range sources {
+		tables[i].File = filepath.Base(source.path)
+
+		if i == 0 {
+			tables[i].Table = "report-current.csv"
+		} else {
+			tables[i].Table = fmt.Sprintf("report-%d.csv", i)
+		}
+	}
+
+	return tables, nil
+}
+
+// TemplatePeriod describes a billing period available to queries.
+// Start and End are formatted the same way as bill/BillingPeriodStartDate
+// and bill/BillingPeriodEndDate columns of the report
+type TemplatePeriod struct {
+	Report string
+	Start  string
+	End    string
+}
+
+// TemplateData is passed to queries, which are Go templates, e.g.
+//
+//	select * from `{{.Report}}` where `bill/BillingPeriodStartDate` = "{{.PeriodStart}}"
+type TemplateData struct {
+	// Table and bounds of the most recent billing period
+	Report      string
+	PeriodStart string
+	PeriodEnd   string
+
+	// All billing periods in the repository, from the most recent one
+	Periods []TemplatePeriod
+
+	// User-defined variables
+	Vars map[string]string
+}
+
+func newTemplateData(config *state.Config) (*TemplateData, error) {
+	tables, err := reportTables(config)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &TemplateData{
+		Periods: make([]TemplatePeriod, 0, len(tables)),
+		Vars:    config.QueryVariables,
+	}
+
+	if data.Vars == nil {
+		data.Vars = map[string]string{}
+	}
+
+	for _, table := range tables {
+		period := TemplatePeriod{Report: table.Table}
+
+		// Report files are named after the period start, see fetcher.GetReportFile
+		if len(table.File) >= 8 {
+			if start, err := time.ParseInLocation("20060102", table.File[:8], time.UTC); err == nil {
+				period.Start = start.Format(time.RFC3339)
+				period.End = start.AddDate(0, 1, 0).Format(time.RFC3339)
+			}
+		}
+
+		data.Periods = append(data.Periods, period)
+	}
+
+	if len(data.Periods) > 0 {
+		data.Report = data.Periods[0].Report
+		data.PeriodStart = data.Periods[0].Start
+		data.PeriodEnd = data.Periods[0].End
+	}
+
+	return data, nil
+}
+
+// Renders query text as Go template, referencing unknown variables is an error
+func renderQuery(query Query, data *TemplateData) (Query, error) {
+	tmpl, err := template.New(query.Name).Option("missingkey=error").Parse(query.Text)
+	if err != nil {
+		return query, err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return query, err
+	}
+
+	return Query{Name: query.Name, Text: b.String()}, nil
+}
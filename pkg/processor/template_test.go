@@ -0,0 +1,78 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+func TestRenderQueryPeriods(t *testing.T) {
+	config := &state.Config{RepositoryPath: writeTestReport(t)}
+
+	// Older assembly of the current period is left behind by a previous download
+	modified := time.Now()
+	for _, file := range []string{"20230901-previous.csv", "20231001-old.csv"} {
+		path := filepath.Join(config.RepositoryPath, "data", file)
+		if err := os.WriteFile(path, []byte(testReport), 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		modified = modified.Add(-time.Hour)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Link of a period which is no longer in the repository
+	if err := os.Symlink(filepath.Join("data", "20230801-removed.csv"), filepath.Join(config.RepositoryPath, "report-2.csv")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := newTemplateData(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"{{.Report}} {{.PeriodStart}} {{.PeriodEnd}}":      "report-current.csv 2023-10-01T00:00:00Z 2023-11-01T00:00:00Z",
+		"{{range .Periods}}{{.Report}} {{.Start}};{{end}}": "report-current.csv 2023-10-01T00:00:00Z;report-1.csv 2023-09-01T00:00:00Z;",
+		"{{len .Periods}}": "2",
+	}
+
+	for text, expected := range cases {
+		rendered, err := renderQuery(Query{Name: "test", Text: text}, data)
+		if err != nil {
+			t.Errorf("renderQuery(%q): %v", text, err)
+			continue
+		}
+
+		if rendered.Text != expected {
+			t.Errorf("renderQuery(%q) = %q, expected %q", text, rendered.Text, expected)
+		}
+	}
+
+	if err := updateSymlinks(config); err != nil {
+		t.Fatal(err)
+	}
+
+	for table, expected := range map[string]string{
+		"report-current.csv": filepath.Join("data", "20231001-test.csv"),
+		"report-1.csv":       filepath.Join("data", "20230901-previous.csv"),
+		"report-2.csv":       "",
+	} {
+		target, err := os.Readlink(filepath.Join(config.RepositoryPath, table))
+		if expected == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s links to %q, expected it to be removed", table, target)
+			}
+			continue
+		}
+
+		if err != nil || target != expected {
+			t.Errorf("%s links to %q (%v), expected %q", table, target, err, expected)
+		}
+	}
+}
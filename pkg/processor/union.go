@@ -0,0 +1,284 @@
+package processor
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+// Virtual table with reports of all retained billing periods
+const unionTable = "report-all.csv"
+
+// Column of union table holding billing period of the row, e.g. 20231001-20231101
+const unionPeriodColumn = "period"
+
+// Matches references to union table with or without extension
+var unionTableReference = regexp.MustCompile("`report-all(\\.csv)?`")
+
+type unionSource struct {
+	period  string
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// prepareUnionTable builds union table if any of queries uses it,
+// queries which fail to render are reported when they are run
+func prepareUnionTable(config *state.Config, data *TemplateData, queries []Query, logger log.Logger) error {
+	if config.QueryEngine == EngineSQLite {
+		// SQLite database has report-all.csv view
+		return nil
+	}
+
+	for _, query := range queries {
+		rendered, err := renderQuery(query, data)
+		if err != nil {
+			continue
+		}
+
+		if unionTableReference.MatchString(rendered.Text) {
+			return updateUnionTable(config, logger)
+		}
+	}
+
+	return nil
+}
+
+// updateUnionTable builds report-all.csv from reports of all periods in the
+// repository. As columns of CUR change over time, the table has union of
+// columns of all reports, which are empty for rows of reports lacking them.
+// The table is rebuilt only when report files change
+func updateUnionTable(config *state.Config, logger log.Logger) error {
+	sources, err := unionSources(config)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.New()
+	for _, source := range sources {
+		fmt.Fprintf(digest, "%s\x00%s\x00%d\x00%d\n", source.period, source.path, source.size, source.modTime.UnixNano())
+	}
+
+	cacheDir := filepath.Join(config.RepositoryPath, "cache")
+	name := "report-all-" + hex.EncodeToString(digest.Sum(nil))[:16] + ".csv"
+	file := filepath.Join(cacheDir, name)
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		level.Info(logger).Log("msg", "Building union table", "file", file, "periods", len(sources))
+
+		if err := os.MkdirAll(cacheDir, 0750); err != nil {
+			return err
+		}
+
+		if err := writeUnionTable(file, sources); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := symlink(filepath.Join(config.RepositoryPath, unionTable), filepath.Join("cache", name)); err != nil {
+		return err
+	}
+
+	// Remove tables built from previous reports
+	items, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if item.Name() != name && strings.HasPrefix(item.Name(), "report-all-") {
+			if err := os.Remove(filepath.Join(cacheDir, item.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Finds the report of each period, data directory may contain reports
+// of previous assemblies, so the most recently downloaded one is used
+func unionSources(config *state.Config) ([]unionSource, error) {
+	dataDir := filepath.Join(config.RepositoryPath, "data")
+
+	items, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := map[string]unionSource{}
+
+	for _, item := range items {
+		if item.IsDir() || !strings.HasSuffix(item.Name(), ".csv") || len(item.Name()) < 8 {
+			continue
+		}
+
+		// Report files are named after the period start, see fetcher.GetReportFile
+		start, err := time.ParseInLocation("20060102", item.Name()[:8], time.UTC)
+		if err != nil {
+			continue
+		}
+
+		info, err := item.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		period := start.Format("20060102") + "-" + start.AddDate(0, 1, 0).Format("20060102")
+
+		if prev, ok := latest[period]; ok && prev.modTime.After(info.ModTime()) {
+			continue
+		}
+
+		latest[period] = unionSource{
+			period:  period,
+			path:    filepath.Join(dataDir, item.Name()),
+			modTime: info.ModTime(),
+			size:    info.Size(),
+		}
+	}
+
+	sources := make([]unionSource, 0, len(latest))
+	for _, source := range latest {
+		sources = append(sources, source)
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].period > sources[j].period
+	})
+
+	return sources, nil
+}
+
+func writeUnionTable(file string, sources []unionSource) error {
+	columns := []string{unionPeriodColumn}
+	positions := map[string]int{}
+
+	for _, source := range sources {
+		header, err := readHeader(source.path)
+		if err != nil {
+			return err
+		}
+
+		for _, column := range header {
+			if _, ok := positions[column]; !ok {
+				positions[column] = len(columns)
+				columns = append(columns, column)
+			}
+		}
+	}
+
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file + ".tmp")
+
+	bw := bufio.NewWriter(f)
+	w := csv.NewWriter(bw)
+
+	if err := w.Write(columns); err != nil {
+		f.Close()
+		return err
+	}
+
+	for _, source := range sources {
+		if err := appendUnionRows(w, source, positions, len(columns)); err != nil {
+			f.Close()
+			return fmt.Errorf("report %s: %w", source.path, err)
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+func readHeader(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header, err := csv.NewReader(bufio.NewReader(f)).Read()
+	if err != nil {
+		return nil, fmt.Errorf("report %s: %w", path, err)
+	}
+
+	return header, nil
+}
+
+func appendUnionRows(w *csv.Writer, source unionSource, positions map[string]int, width int) error {
+	f, err := os.Open(source.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(bufio.NewReaderSize(f, 1<<20))
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		return err
+	}
+
+	mapping := make([]int, len(header))
+	for i, column := range header {
+		mapping[i] = positions[column]
+	}
+
+	record := make([]string, width)
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for i := range record {
+			record[i] = ""
+		}
+		record[0] = source.period
+
+		for i, value := range row {
+			record[mapping[i]] = value
+		}
+
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+}
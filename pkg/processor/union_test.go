@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+type testFile struct {
+	name    string
+	content string
+}
+
+// Writes report files to data directory, each modified after the previous one
+func writeTestFiles(t *testing.T, repository string, modified time.Time, files ...testFile) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Join(repository, "data"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, file := range files {
+		path := filepath.Join(repository, "data", file.name)
+		if err := os.WriteFile(path, []byte(file.content), 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		at := modified.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUpdateUnionTable(t *testing.T) {
+	cases := []struct {
+		name     string
+		files    []testFile
+		expected string
+	}{
+		{
+			"period column",
+			[]testFile{{"20231001-a.csv", "x,y\n1,2\n"}},
+			"period,x,y\n20231001-20231101,1,2\n",
+		},
+		{
+			"missing columns are empty",
+			[]testFile{{"20231001-a.csv", "x,y\n1,2\n"}, {"20230901-b.csv", "x\n3\n"}},
+			"period,x,y\n20231001-20231101,1,2\n20230901-20231001,3,\n",
+		},
+		{
+			"columns in different order",
+			[]testFile{{"20231001-a.csv", "y,x\n2,1\n"}, {"20230901-b.csv", "x,z\n3,4\n"}},
+			"period,y,x,z\n20231001-20231101,2,1,\n20230901-20231001,,3,4\n",
+		},
+		{
+			"latest assembly of period",
+			[]testFile{{"20231001-b.csv", "x\n1\n"}, {"20231001-a.csv", "x\n2\n"}},
+			"period,x\n20231001-20231101,2\n",
+		},
+		{
+			"other files are ignored",
+			[]testFile{{"20231001-a.csv", "x\n1\n"}, {"20231001-b.csv.tmp", "x\n2\n"}, {"manifest.json", "{}"}},
+			"period,x\n20231001-20231101,1\n",
+		},
+	}
+
+	for _, c := range cases {
+		config := &state.Config{RepositoryPath: t.TempDir()}
+		writeTestFiles(t, config.RepositoryPath, time.Now(), c.files...)
+
+		if err := updateUnionTable(config, log.NewNopLogger()); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(config.RepositoryPath, unionTable))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if string(data) != c.expected {
+			t.Errorf("%s: union table %q, expected %q", c.name, data, c.expected)
+		}
+	}
+}
+
+func TestUpdateUnionTableRebuild(t *testing.T) {
+	config := &state.Config{RepositoryPath: t.TempDir()}
+	modified := time.Now()
+
+	writeTestFiles(t, config.RepositoryPath, modified, testFile{"20231001-a.csv", "x\n1\n"})
+
+	cases := []struct {
+		name    string
+		files   []testFile
+		rebuilt bool
+	}{
+		{"unchanged", nil, false},
+		{"report updated", []testFile{{"20231001-a.csv", "x\n2\n"}}, true},
+		{"period added", []testFile{{"20230901-a.csv", "x\n3\n"}}, true},
+		{"unchanged after update", nil, false},
+	}
+
+	if err := updateUnionTable(config, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := os.Readlink(filepath.Join(config.RepositoryPath, unionTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		modified = modified.Add(time.Minute)
+		writeTestFiles(t, config.RepositoryPath, modified, c.files...)
+
+		if err := updateUnionTable(config, log.NewNopLogger()); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		updated, err := os.Readlink(filepath.Join(config.RepositoryPath, unionTable))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if (updated != table) != c.rebuilt {
+			t.Errorf("%s: union table %s after %s, expected rebuilt %v", c.name, updated, table, c.rebuilt)
+		}
+
+		// Only the current table is kept
+		if matches, _ := filepath.Glob(filepath.Join(config.RepositoryPath, "cache", "report-all-*")); len(matches) != 1 {
+			t.Errorf("%s: cache has union tables %v, expected one", c.name, matches)
+		}
+
+		table = updated
+	}
+
+	data, err := os.ReadFile(filepath.Join(config.RepositoryPath, unionTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "period,x\n20231001-20231101,2\n20230901-20231001,3\n"; string(data) != expected {
+		t.Errorf("union table %q, expected %q", data, expected)
+	}
+}
@@ -0,0 +1,194 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/state"
+)
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic describes a problem found in a query file.
+// Line and column are 1-based and zero when position is unknown
+type Diagnostic struct {
+	Query    string
+	Line     int
+	Column   int
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	position := d.Query
+	if d.Line > 0 {
+		position += ":" + strconv.Itoa(d.Line)
+
+		if d.Column > 0 {
+			position += ":" + strconv.Itoa(d.Column)
+		}
+	}
+
+	return fmt.Sprintf("%s: %s: %s", position, d.Severity, d.Message)
+}
+
+// csvq reports error positions as "[L:1 C:8] message"
+var csvqPosition = regexp.MustCompile(`^\[L:(\d+) C:(\d+)\] (.*)$`)
+
+// text/template reports error positions as "template: name:1:8: message"
+var templatePosition = regexp.MustCompile(`^template: .*?:(\d+):(?:(\d+):)? (.*)$`)
+
+// Validate runs all queries against reports in the repository and returns
+// diagnostics for every query, unlike Compute which stops at the first error
+func Validate(ctx context.Context, config *state.Config, logger log.Logger) ([]Diagnostic, error) {
+	queries, err := LoadQueries(config)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := Open(config, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			level.Warn(logger).Log("msg", "Unable to close database", "err", err)
+		}
+	}()
+
+	data, err := newTemplateData(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := prepareUnionTable(config, data, queries, logger); err != nil {
+		return nil, err
+	}
+
+	diagnostics := make([]Diagnostic, 0)
+	set := newMetricSet()
+
+	for _, query := range queries {
+		level.Debug(logger).Log("msg", "Validating query", "name", query.Name)
+
+		if _, err := runQuery(ctx, db, data, set, query, nil); err != nil {
+			diagnostics = append(diagnostics, diagnose(query, err))
+		}
+	}
+
+	for _, conflict := range set.conflicts() {
+		diagnostics = append(diagnostics, Diagnostic{
+			Query:    conflict.queries[1],
+			Severity: SeverityError,
+			Message:  conflict.Error(),
+		})
+	}
+
+	for _, query := range queries {
+		for _, name := range set.order {
+			f := set.families[name]
+
+			labels, ok := f.queryLabels[query.Name]
+			if !ok || len(labels) == len(f.labels) {
+				continue
+			}
+
+			missing := make([]string, 0)
+			for _, label := range f.labels {
+				found := false
+				for _, l := range labels {
+					if l == label {
+						found = true
+						break
+					}
+				}
+
+				if !found {
+					missing = append(missing, label)
+				}
+			}
+
+			line, column := locate(query.Text, f.queryColumns[query.Name])
+
+			diagnostics = append(diagnostics, Diagnostic{
+				Query:    query.Name,
+				Line:     line,
+				Column:   column,
+				Severity: SeverityWarning,
+				Message: fmt.Sprintf(
+					"metric %s has labels %s in other queries, they are exported empty for this query",
+					name, strings.Join(missing, ", "),
+				),
+			})
+		}
+	}
+
+	return diagnostics, nil
+}
+
+func diagnose(query Query, err error) Diagnostic {
+	d := Diagnostic{
+		Query:    query.Name,
+		Severity: SeverityError,
+		Message:  err.Error(),
+	}
+
+	var he *headerError
+	if errors.As(err, &he) {
+		d.Line = he.line
+		d.Message = he.err.Error()
+		return d
+	}
+
+	var ce *columnError
+	if errors.As(err, &ce) {
+		d.Line, d.Column = locate(query.Text, ce.column)
+		return d
+	}
+
+	if match := csvqPosition.FindStringSubmatch(err.Error()); match != nil {
+		d.Line, _ = strconv.Atoi(match[1])
+		d.Column, _ = strconv.Atoi(match[2])
+		d.Message = match[3]
+	} else if match := templatePosition.FindStringSubmatch(err.Error()); match != nil {
+		d.Line, _ = strconv.Atoi(match[1])
+		d.Column, _ = strconv.Atoi(match[2])
+		d.Message = "template: " + match[3]
+	}
+
+	return d
+}
+
+// Finds position of the column alias in query text,
+// falling back to the first occurrence of its name
+func locate(text string, name string) (line int, column int) {
+	var offset int
+
+	alias := regexp.MustCompile("(?i)\\bas\\s+[`\"]?(" + regexp.QuoteMeta(name) + ")")
+	if loc := alias.FindStringSubmatchIndex(text); loc != nil {
+		offset = loc[2]
+	} else {
+		offset = strings.Index(text, name)
+	}
+
+	if offset < 0 {
+		return 0, 0
+	}
+
+	line = strings.Count(text[:offset], "\n") + 1
+	column = offset - strings.LastIndex(text[:offset], "\n")
+
+	return line, column
+}
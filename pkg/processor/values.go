@@ -0,0 +1,87 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var errNullValue = errors.New("unexpected NULL value, use COALESCE to provide a default")
+
+// Converts csvq value to label value the same way
+// database/sql converts it when scanning into a string
+func labelValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", errNullValue
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+func metricValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, errNullValue
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case []byte:
+		return strconv.ParseFloat(string(v), 64)
+	default:
+		return 0, fmt.Errorf("unsupported value type %T for metric", value)
+	}
+}
+
+// Layouts of datetime values in CUR columns
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Converts csvq value to sample timestamp, numbers are treated as Unix time in seconds
+func timestampValue(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case nil:
+		return time.Time{}, errNullValue
+	case time.Time:
+		return v, nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case float64:
+		return time.UnixMilli(int64(v * 1000)), nil
+	case string:
+		return ParseTimestamp(v)
+	default:
+		return time.Time{}, fmt.Errorf("unsupported value type %T for timestamp", value)
+	}
+}
+
+// ParseTimestamp parses datetime formatted as in CUR columns
+func ParseTimestamp(value string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unable to parse timestamp: %q", value)
+}
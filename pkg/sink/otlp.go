@@ -0,0 +1,359 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Transport protocols of OTLP, named like values
+// of OTEL_EXPORTER_OTLP_PROTOCOL environment variable
+const (
+	OTLPProtocolHTTP = "http/protobuf"
+	OTLPProtocolGRPC = "grpc"
+)
+
+type OTLPConfig struct {
+	// OTLP/HTTP endpoint, /v1/metrics is used if URL has no path.
+	// Only scheme and host are used with gRPC, http means plaintext
+	Endpoint string
+	Protocol string
+	Timeout  time.Duration
+	Headers  map[string]string
+
+	ResourceAttributes map[string]string
+}
+
+// OTLP exports metrics to OpenTelemetry collector using OTLP/HTTP or
+// OTLP/gRPC with protobuf encoding. Metric families become OTel gauges,
+// monotonic sums for counters, histograms or summaries, with labels
+// as attributes
+type OTLP struct {
+	config   OTLPConfig
+	endpoint string
+
+	// Exactly one of them is set depending on protocol
+	client     *http.Client
+	grpcClient colmetricspb.MetricsServiceClient
+
+	// Start of cumulative sums, histograms and summaries. Values computed
+	// from reports only grow while the exporter runs, so they are reported
+	// as accumulated since the exporter started
+	start time.Time
+}
+
+func NewOTLP(config OTLPConfig) (*OTLP, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("OTLP endpoint must be http or https URL: %s", config.Endpoint)
+	}
+
+	o := &OTLP{
+		config: config,
+		start:  time.Now(),
+	}
+
+	switch config.Protocol {
+	case OTLPProtocolHTTP, "":
+		if endpoint.Path == "" || endpoint.Path == "/" {
+			endpoint.Path = "/v1/metrics"
+		}
+
+		o.endpoint = endpoint.String()
+		o.client = &http.Client{Timeout: config.Timeout}
+
+	case OTLPProtocolGRPC:
+		creds := insecure.NewCredentials()
+		if endpoint.Scheme == "https" {
+			creds = credentials.NewTLS(&tls.Config{})
+		}
+
+		// Connection is established on first export and
+		// reestablished by the client if it breaks
+		conn, err := grpc.Dial(endpoint.Host,
+			grpc.WithTransportCredentials(creds),
+			grpc.WithUserAgent("aws-cost-exporter"),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		o.endpoint = endpoint.Host
+		o.grpcClient = colmetricspb.NewMetricsServiceClient(conn)
+
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol: %s", config.Protocol)
+	}
+
+	return o, nil
+}
+
+func (o *OTLP) Name() string {
+	return "otlp"
+}
+
+func (o *OTLP) Send(ctx context.Context, gatherer prometheus.Gatherer) error {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	metrics := make([]*metricspb.Metric, 0, len(mfs))
+
+	for _, mf := range mfs {
+		if metric, ok := o.otlpMetric(mf, now); ok {
+			metrics = append(metrics, metric)
+		}
+	}
+
+	request := &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{
+				Attributes: otlpAttributes(o.config.ResourceAttributes),
+			},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope: &commonpb.InstrumentationScope{
+					Name:    "github.com/st8ed/aws-cost-exporter",
+					Version: version.Version,
+				},
+				Metrics: metrics,
+			}},
+		}},
+	}
+
+	if o.grpcClient != nil {
+		return o.exportGRPC(ctx, request)
+	}
+
+	return o.exportHTTP(ctx, request)
+}
+
+func (o *OTLP) exportHTTP(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "aws-cost-exporter")
+
+	for name, value := range o.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTLP endpoint returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+func (o *OTLP) exportGRPC(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+	if o.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.config.Timeout)
+		defer cancel()
+	}
+
+	if len(o.config.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(o.config.Headers))
+	}
+
+	resp, err := o.grpcClient.Export(ctx, request)
+	if err != nil {
+		return fmt.Errorf("OTLP endpoint %s: %w", o.endpoint, err)
+	}
+
+	if rejected := resp.GetPartialSuccess().GetRejectedDataPoints(); rejected > 0 {
+		return fmt.Errorf("OTLP endpoint %s rejected %d data points: %s", o.endpoint, rejected, resp.GetPartialSuccess().GetErrorMessage())
+	}
+
+	return nil
+}
+
+// Converts metric family to OTLP metric, start of cumulative points
+// is never after their time, which may be set explicitly by a query
+func (o *OTLP) otlpMetric(mf *dto.MetricFamily, now time.Time) (*metricspb.Metric, bool) {
+	metric := &metricspb.Metric{
+		Name:        mf.GetName(),
+		Description: mf.GetHelp(),
+	}
+
+	var (
+		numbers    []*metricspb.NumberDataPoint
+		histograms []*metricspb.HistogramDataPoint
+		summaries  []*metricspb.SummaryDataPoint
+	)
+
+	for _, m := range mf.Metric {
+		timestamp := now
+		if m.TimestampMs != nil {
+			timestamp = time.UnixMilli(m.GetTimestampMs())
+		}
+
+		start := o.start
+		if timestamp.Before(start) {
+			start = timestamp
+		}
+
+		labels := make(map[string]string, len(m.Label))
+		for _, label := range m.Label {
+			if label.GetValue() != "" {
+				labels[label.GetName()] = label.GetValue()
+			}
+		}
+		attributes := otlpAttributes(labels)
+
+		switch mf.GetType() {
+		case dto.MetricType_HISTOGRAM:
+			histograms = append(histograms, otlpHistogramPoint(m.GetHistogram(), attributes, start, timestamp))
+
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+
+			point := &metricspb.SummaryDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: uint64(start.UnixNano()),
+				TimeUnixNano:      uint64(timestamp.UnixNano()),
+				Count:             s.GetSampleCount(),
+				Sum:               s.GetSampleSum(),
+			}
+
+			for _, q := range s.GetQuantile() {
+				point.QuantileValues = append(point.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+					Quantile: q.GetQuantile(),
+					Value:    q.GetValue(),
+				})
+			}
+
+			summaries = append(summaries, point)
+
+		default:
+			value, ok := metricValue(mf.GetType(), m)
+			if !ok {
+				return nil, false
+			}
+
+			point := &metricspb.NumberDataPoint{
+				Attributes:   attributes,
+				TimeUnixNano: uint64(timestamp.UnixNano()),
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+			}
+
+			// Gauges have no start, it is only meaningful for sums
+			if mf.GetType() == dto.MetricType_COUNTER {
+				point.StartTimeUnixNano = uint64(start.UnixNano())
+			}
+
+			numbers = append(numbers, point)
+		}
+	}
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			DataPoints:             numbers,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}}
+
+	case dto.MetricType_HISTOGRAM:
+		metric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			DataPoints:             histograms,
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		}}
+
+	case dto.MetricType_SUMMARY:
+		metric.Data = &metricspb.Metric_Summary{Summary: &metricspb.Summary{DataPoints: summaries}}
+
+	default:
+		metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: numbers}}
+	}
+
+	return metric, true
+}
+
+// OTLP bucket counts are not cumulative and include the implicit +Inf bucket
+func otlpHistogramPoint(h *dto.Histogram, attributes []*commonpb.KeyValue, start time.Time, timestamp time.Time) *metricspb.HistogramDataPoint {
+	sum := h.GetSampleSum()
+
+	point := &metricspb.HistogramDataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: uint64(start.UnixNano()),
+		TimeUnixNano:      uint64(timestamp.UnixNano()),
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+	}
+
+	previous := uint64(0)
+
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+
+		point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, b.GetCumulativeCount()-previous)
+		previous = b.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, h.GetSampleCount()-previous)
+
+	return point
+}
+
+// Converts attributes to KeyValue list with string values sorted by key
+func otlpAttributes(attributes map[string]string) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]*commonpb.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		kvs = append(kvs, &commonpb.KeyValue{
+			Key:   key,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: attributes[key]}},
+		})
+	}
+
+	return kvs
+}
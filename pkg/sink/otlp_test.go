@@ -0,0 +1,269 @@
+package sink
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func testGatherer() prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+
+	cost := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "aws_cost", Help: "Cost."}, []string{"product"})
+	cost.WithLabelValues("AmazonEC2").Set(1.5)
+	registry.MustRegister(cost)
+
+	return registry
+}
+
+// Exports every metric type, the counter with explicit timestamp
+func testTypedGatherer() prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+
+	at := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	counter := prometheus.NewDesc("aws_usage", "Usage.", nil, nil)
+	histogram := prometheus.NewDesc("aws_line_item_cost", "Line item cost.", nil, nil)
+	summary := prometheus.NewDesc("aws_rate", "Rate.", nil, nil)
+
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.NewMetricWithTimestamp(at, prometheus.MustNewConstMetric(counter, prometheus.CounterValue, 10))
+		ch <- prometheus.MustNewConstHistogram(histogram, 4, 21, map[float64]uint64{1: 1, 10: 3})
+		ch <- prometheus.MustNewConstSummary(summary, 2, 3, map[float64]float64{0.5: 1})
+	}))
+
+	return registry
+}
+
+func TestOTLPHTTP(t *testing.T) {
+	cases := []struct {
+		status int
+		err    string
+	}{
+		{http.StatusOK, ""},
+		{http.StatusUnauthorized, "401"},
+	}
+
+	for _, c := range cases {
+		request := &colmetricspb.ExportMetricsServiceRequest{}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+
+			body, _ := io.ReadAll(r.Body)
+			if err := proto.Unmarshal(body, request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.WriteHeader(c.status)
+		}))
+
+		o, err := NewOTLP(OTLPConfig{
+			Endpoint:           server.URL,
+			Timeout:            5 * time.Second,
+			Headers:            map[string]string{"Authorization": "Bearer token"},
+			ResourceAttributes: map[string]string{"service.name": "aws-cost-exporter"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = o.Send(context.Background(), testGatherer())
+		server.Close()
+
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("Send() = %v, expected error with %q", err, c.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resource := request.GetResourceMetrics()[0]
+		if kv := resource.GetResource().GetAttributes(); len(kv) != 1 || kv[0].GetKey() != "service.name" || kv[0].GetValue().GetStringValue() != "aws-cost-exporter" {
+			t.Errorf("resource attributes = %v", kv)
+		}
+
+		metric := resource.GetScopeMetrics()[0].GetMetrics()[0]
+		point := metric.GetGauge().GetDataPoints()[0]
+
+		if metric.GetName() != "aws_cost" || metric.GetDescription() != "Cost." || point.GetAsDouble() != 1.5 {
+			t.Errorf("metric = %v", metric)
+		}
+
+		if kv := point.GetAttributes(); len(kv) != 1 || kv[0].GetKey() != "product" || kv[0].GetValue().GetStringValue() != "AmazonEC2" {
+			t.Errorf("attributes = %v", kv)
+		}
+	}
+}
+
+func TestOTLPMetricTypes(t *testing.T) {
+	o, err := NewOTLP(OTLPConfig{Endpoint: "http://collector:4318"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := testTypedGatherer().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := o.start.Add(time.Minute)
+	metrics := map[string]*metricspb.Metric{}
+
+	for _, mf := range mfs {
+		metric, ok := o.otlpMetric(mf, now)
+		if !ok {
+			t.Fatalf("metric %s is not exported", mf.GetName())
+		}
+
+		// Decode with official protos to check the message is valid
+		data, err := proto.Marshal(metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := &metricspb.Metric{}
+		if err := proto.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		metrics[decoded.GetName()] = decoded
+	}
+
+	at := uint64(time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+
+	sum := metrics["aws_usage"].GetSum()
+	if sum.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE || !sum.GetIsMonotonic() {
+		t.Errorf("sum = %v, expected cumulative monotonic", sum)
+	}
+
+	// Explicit timestamp precedes start of the exporter
+	if point := sum.GetDataPoints()[0]; point.GetAsDouble() != 10 || point.GetTimeUnixNano() != at || point.GetStartTimeUnixNano() != at {
+		t.Errorf("sum point = %v", point)
+	}
+
+	histogram := metrics["aws_line_item_cost"].GetHistogram()
+	point := histogram.GetDataPoints()[0]
+
+	if histogram.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+		t.Errorf("histogram = %v, expected cumulative", histogram)
+	}
+
+	if !reflect.DeepEqual(point.GetExplicitBounds(), []float64{1, 10}) || !reflect.DeepEqual(point.GetBucketCounts(), []uint64{1, 2, 1}) ||
+		point.GetCount() != 4 || point.GetSum() != 21 {
+		t.Errorf("histogram point = %v", point)
+	}
+
+	if point.GetStartTimeUnixNano() != uint64(o.start.UnixNano()) || point.GetTimeUnixNano() != uint64(now.UnixNano()) {
+		t.Errorf("histogram point spans %d - %d, expected %d - %d", point.GetStartTimeUnixNano(), point.GetTimeUnixNano(), o.start.UnixNano(), now.UnixNano())
+	}
+
+	summary := metrics["aws_rate"].GetSummary().GetDataPoints()[0]
+	if summary.GetCount() != 2 || summary.GetSum() != 3 || len(summary.GetQuantileValues()) != 1 || summary.GetStartTimeUnixNano() != uint64(o.start.UnixNano()) {
+		t.Errorf("summary point = %v", summary)
+	}
+}
+
+type testMetricsService struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	requests []*colmetricspb.ExportMetricsServiceRequest
+}
+
+func (s *testMetricsService) Export(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if token := md.Get("authorization"); len(token) != 1 || token[0] != "Bearer token" {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+
+	s.requests = append(s.requests, request)
+
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestOTLPGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := &testMetricsService{}
+	server := grpc.NewServer()
+	colmetricspb.RegisterMetricsServiceServer(server, service)
+
+	go server.Serve(listener)
+	defer server.Stop()
+
+	cases := []struct {
+		headers map[string]string
+		err     string
+	}{
+		{map[string]string{"Authorization": "Bearer token"}, ""},
+		{nil, "missing token"},
+	}
+
+	for _, c := range cases {
+		o, err := NewOTLP(OTLPConfig{
+			Endpoint: "http://" + listener.Addr().String(),
+			Protocol: OTLPProtocolGRPC,
+			Timeout:  5 * time.Second,
+			Headers:  c.headers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = o.Send(context.Background(), testGatherer())
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("Send() = %v, expected error with %q", err, c.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(service.requests) != 1 {
+		t.Fatalf("received %d requests, expected 1", len(service.requests))
+	}
+
+	if name := service.requests[0].GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetName(); name != "aws_cost" {
+		t.Errorf("received metric %s, expected aws_cost", name)
+	}
+}
+
+func TestNewOTLP(t *testing.T) {
+	for _, config := range []OTLPConfig{
+		{Endpoint: "collector:4318"},
+		{Endpoint: "grpc://collector:4317", Protocol: OTLPProtocolGRPC},
+		{Endpoint: "http://collector:4318", Protocol: "http/json"},
+	} {
+		if _, err := NewOTLP(config); err == nil {
+			t.Errorf("NewOTLP(%+v) succeeded, expected error", config)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+type PushgatewayConfig struct {
+	URL      string
+	Job      string
+	Grouping map[string]string
+
+	Username     string
+	PasswordFile string
+}
+
+// Pushgateway replaces metrics of the job and grouping
+// labels in Prometheus Pushgateway with computed ones
+type Pushgateway struct {
+	config   PushgatewayConfig
+	password string
+}
+
+func NewPushgateway(config PushgatewayConfig) (*Pushgateway, error) {
+	p := &Pushgateway{
+		config: config,
+	}
+
+	if config.PasswordFile != "" {
+		password, err := os.ReadFile(config.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+
+		p.password = strings.TrimSpace(string(password))
+	}
+
+	return p, nil
+}
+
+func (p *Pushgateway) Name() string {
+	return "pushgateway"
+}
+
+func (p *Pushgateway) Send(ctx context.Context, gatherer prometheus.Gatherer) error {
+	pusher := push.New(p.config.URL, p.config.Job).Gatherer(WithoutTimestamps(gatherer))
+
+	for name, value := range p.config.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	if p.config.Username != "" {
+		pusher = pusher.BasicAuth(p.config.Username, p.password)
+	}
+
+	return pusher.PushContext(ctx)
+}
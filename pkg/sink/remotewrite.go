@@ -0,0 +1,354 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/processor"
+)
+
+type RemoteWriteConfig struct {
+	URL     string
+	Timeout time.Duration
+
+	Username        string
+	PasswordFile    string
+	BearerTokenFile string
+
+	// Label holding sample timestamp, e.g. `lineItem/UsageStartDate`
+	// selected in a query. It is removed from written series.
+	// Timestamps are taken only from samples if empty
+	TimestampLabel string
+
+	// Maximum number of samples in a single request, it may be
+	// exceeded by the last series since series aren't split
+	BatchSize int
+}
+
+// RemoteWrite writes metrics using Prometheus remote write protocol.
+// Unlike scrapes, samples may carry timestamps of billing data,
+// so past periods can be backfilled into remote storage
+type RemoteWrite struct {
+	config   RemoteWriteConfig
+	client   *http.Client
+	password string
+	token    string
+}
+
+func NewRemoteWrite(config RemoteWriteConfig) (*RemoteWrite, error) {
+	rw := &RemoteWrite{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+
+	if config.PasswordFile != "" {
+		password, err := os.ReadFile(config.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+
+		rw.password = strings.TrimSpace(string(password))
+	}
+
+	if config.BearerTokenFile != "" {
+		token, err := os.ReadFile(config.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+
+		rw.token = strings.TrimSpace(string(token))
+	}
+
+	if rw.config.BatchSize <= 0 {
+		rw.config.BatchSize = 1000
+	}
+
+	return rw, nil
+}
+
+func (rw *RemoteWrite) Name() string {
+	return "remote-write"
+}
+
+func (rw *RemoteWrite) Send(ctx context.Context, gatherer prometheus.Gatherer) error {
+	mfs, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+
+	// Rows differing only in the timestamp label become samples of the
+	// same series, they are written in one time series ordered by time,
+	// since receivers reject samples older than the last one of the series
+	series := make(map[string]*timeSeries)
+	order := make([]string, 0)
+
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			timestamp := now
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+
+			labels := map[string]string{}
+
+			for _, label := range m.Label {
+				if label.GetName() == rw.config.TimestampLabel && rw.config.TimestampLabel != "" {
+					t, err := processor.ParseTimestamp(label.GetValue())
+					if err != nil {
+						return fmt.Errorf("metric %s: label %s: %w", mf.GetName(), label.GetName(), err)
+					}
+
+					timestamp = t.UnixMilli()
+					continue
+				}
+
+				if label.GetValue() != "" {
+					labels[label.GetName()] = label.GetValue()
+				}
+			}
+
+			for _, s := range flatten(mf, m) {
+				seriesLabels := make(map[string]string, len(labels)+2)
+				for name, value := range labels {
+					seriesLabels[name] = value
+				}
+
+				seriesLabels["__name__"] = mf.GetName() + s.suffix
+				if s.label != "" {
+					seriesLabels[s.label] = s.labelValue
+				}
+
+				key := seriesKey(seriesLabels)
+
+				ts, ok := series[key]
+				if !ok {
+					ts = &timeSeries{labels: seriesLabels}
+					series[key] = ts
+					order = append(order, key)
+				}
+
+				ts.samples = append(ts.samples, timedSample{s.value, timestamp})
+			}
+		}
+	}
+
+	batch := make([]byte, 0)
+	size := 0
+
+	for _, key := range order {
+		ts := series[key]
+
+		sort.SliceStable(ts.samples, func(i, j int) bool {
+			return ts.samples[i].timestamp < ts.samples[j].timestamp
+		})
+
+		batch = protowire.AppendTag(batch, 1, protowire.BytesType)
+		batch = protowire.AppendBytes(batch, encodeTimeSeries(ts.labels, ts.samples))
+		size += len(ts.samples)
+
+		if size >= rw.config.BatchSize {
+			if err := rw.write(ctx, batch); err != nil {
+				return err
+			}
+
+			batch = batch[:0]
+			size = 0
+		}
+	}
+
+	if size > 0 {
+		return rw.write(ctx, batch)
+	}
+
+	return nil
+}
+
+type timeSeries struct {
+	labels  map[string]string
+	samples []timedSample
+}
+
+type timedSample struct {
+	value     float64
+	timestamp int64
+}
+
+// Identifies series by its labels regardless of their order
+func seriesKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(labels[name])
+		b.WriteByte(0)
+	}
+
+	return b.String()
+}
+
+func (rw *RemoteWrite) write(ctx context.Context, request []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rw.config.URL, bytes.NewReader(snappy.Encode(nil, request)))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "aws-cost-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if rw.config.Username != "" {
+		req.SetBasicAuth(rw.config.Username, rw.password)
+	}
+
+	if rw.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rw.token)
+	}
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// Encodes prometheus.TimeSeries message, labels are sorted by name
+// and samples have to be ordered by time as required by the protocol
+func encodeTimeSeries(labels map[string]string, samples []timedSample) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := make([]byte, 0, 128)
+
+	for _, name := range names {
+		label := protowire.AppendTag(nil, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, label)
+	}
+
+	for _, s := range samples {
+		sample := protowire.AppendTag(nil, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sample)
+	}
+
+	return b
+}
+
+func metricValue(t dto.MetricType, m *dto.Metric) (float64, bool) {
+	switch t {
+	case dto.MetricType_GAUGE:
+		return m.GetGauge().GetValue(), true
+	case dto.MetricType_COUNTER:
+		return m.GetCounter().GetValue(), true
+	case dto.MetricType_UNTYPED:
+		return m.GetUntyped().GetValue(), true
+	default:
+		return 0, false
+	}
+}
+
+// flatSample is a single series of a metric in Prometheus data model,
+// histograms and summaries consist of several such series
+type flatSample struct {
+	suffix     string
+	label      string
+	labelValue string
+	value      float64
+}
+
+// Splits metric into series the same way as text exposition format does
+func flatten(mf *dto.MetricFamily, m *dto.Metric) []flatSample {
+	if value, ok := metricValue(mf.GetType(), m); ok {
+		return []flatSample{{value: value}}
+	}
+
+	samples := make([]flatSample, 0)
+
+	switch mf.GetType() {
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		infSeen := false
+
+		for _, b := range h.GetBucket() {
+			if math.IsInf(b.GetUpperBound(), 1) {
+				infSeen = true
+			}
+
+			samples = append(samples, flatSample{
+				"_bucket", "le", formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()),
+			})
+		}
+
+		if !infSeen {
+			samples = append(samples, flatSample{"_bucket", "le", "+Inf", float64(h.GetSampleCount())})
+		}
+
+		samples = append(samples,
+			flatSample{suffix: "_sum", value: h.GetSampleSum()},
+			flatSample{suffix: "_count", value: float64(h.GetSampleCount())},
+		)
+
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+
+		for _, q := range s.GetQuantile() {
+			samples = append(samples, flatSample{"", "quantile", formatFloat(q.GetQuantile()), q.GetValue()})
+		}
+
+		samples = append(samples,
+			flatSample{suffix: "_sum", value: s.GetSampleSum()},
+			flatSample{suffix: "_count", value: float64(s.GetSampleCount())},
+		)
+	}
+
+	return samples
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,219 @@
+package sink
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodedSeries is prometheus.TimeSeries message decoded in tests
+type decodedSeries struct {
+	labels  []string
+	samples []timedSample
+}
+
+func decodeTimeSeries(t *testing.T, b []byte) decodedSeries {
+	t.Helper()
+
+	var ts decodedSeries
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("malformed time series")
+		}
+		b = b[n:]
+
+		field, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatalf("malformed time series")
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			var label [2]string
+			for len(field) > 0 {
+				num, _, n := protowire.ConsumeTag(field)
+				value, m := protowire.ConsumeString(field[n:])
+				if n < 0 || m < 0 || num < 1 || num > 2 {
+					t.Fatalf("malformed label")
+				}
+
+				label[num-1] = value
+				field = field[n+m:]
+			}
+
+			ts.labels = append(ts.labels, label[0]+"="+label[1])
+
+		case 2:
+			var s timedSample
+			for len(field) > 0 {
+				num, _, n := protowire.ConsumeTag(field)
+				field = field[n:]
+
+				switch num {
+				case 1:
+					v, m := protowire.ConsumeFixed64(field)
+					s.value, field = math.Float64frombits(v), field[m:]
+				case 2:
+					v, m := protowire.ConsumeVarint(field)
+					s.timestamp, field = int64(v), field[m:]
+				default:
+					t.Fatalf("unexpected sample field %d", num)
+				}
+			}
+
+			ts.samples = append(ts.samples, s)
+		}
+	}
+
+	return ts
+}
+
+func TestEncodeTimeSeries(t *testing.T) {
+	labels := map[string]string{"product": "AmazonEC2", "__name__": "aws_cost", "account": "1"}
+	samples := []timedSample{{1.5, 1696118400000}, {-2, 1696204800000}}
+
+	ts := decodeTimeSeries(t, encodeTimeSeries(labels, samples))
+
+	if expected := []string{"__name__=aws_cost", "account=1", "product=AmazonEC2"}; !reflect.DeepEqual(ts.labels, expected) {
+		t.Errorf("labels = %v, expected %v", ts.labels, expected)
+	}
+
+	if !reflect.DeepEqual(ts.samples, samples) {
+		t.Errorf("samples = %v, expected %v", ts.samples, samples)
+	}
+}
+
+func TestRemoteWriteOrdersSamples(t *testing.T) {
+	var requests [][]byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		request, err := snappy.Decode(nil, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		requests = append(requests, request)
+	}))
+	defer server.Close()
+
+	desc := prometheus.NewDesc("aws_daily_cost", "Cost.", []string{"day", "product"}, nil)
+
+	// Rows are in the order of the query, not by day
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 3, "2023-10-03", "AmazonEC2")
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "2023-10-01", "AmazonEC2")
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2, "2023-10-02", "AmazonEC2")
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 5, "2023-10-01", "AmazonS3")
+	}))
+
+	rw, err := NewRemoteWrite(RemoteWriteConfig{URL: server.URL, Timeout: 5 * time.Second, TimestampLabel: "day"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Send(context.Background(), registry); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("received %d requests, expected 1", len(requests))
+	}
+
+	series := make(map[string][]timedSample)
+
+	for b := requests[0]; len(b) > 0; {
+		_, _, n := protowire.ConsumeTag(b)
+		field, m := protowire.ConsumeBytes(b[n:])
+		b = b[n+m:]
+
+		ts := decodeTimeSeries(t, field)
+		series[ts.labels[1]] = ts.samples
+	}
+
+	day := func(d int) int64 {
+		return time.Date(2023, 10, d, 0, 0, 0, 0, time.UTC).UnixMilli()
+	}
+
+	expected := map[string][]timedSample{
+		"product=AmazonEC2": {{1, day(1)}, {2, day(2)}, {3, day(3)}},
+		"product=AmazonS3":  {{5, day(1)}},
+	}
+
+	if !reflect.DeepEqual(series, expected) {
+		t.Errorf("series = %v, expected %v", series, expected)
+	}
+}
+
+func TestRemoteWriteInvalidTimestamp(t *testing.T) {
+	cost := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "aws_daily_cost"}, []string{"day"})
+	cost.WithLabelValues("yesterday").Set(1)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(cost)
+
+	rw, err := NewRemoteWrite(RemoteWriteConfig{URL: "http://127.0.0.1:0", TimestampLabel: "day"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Send(context.Background(), registry); err == nil {
+		t.Errorf("Send() succeeded, expected error for invalid timestamp")
+	}
+}
+
+// Without timestamp label, timestamps come from samples and labels are kept
+func TestRemoteWriteSampleTimestamps(t *testing.T) {
+	var request []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request, _ = snappy.Decode(nil, body)
+	}))
+	defer server.Close()
+
+	desc := prometheus.NewDesc("aws_cost", "Cost.", []string{"timestamp"}, nil)
+	at := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.NewMetricWithTimestamp(at, prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "daily"))
+	}))
+
+	rw, err := NewRemoteWrite(RemoteWriteConfig{URL: server.URL, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rw.Send(context.Background(), registry); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, n := protowire.ConsumeTag(request)
+	field, _ := protowire.ConsumeBytes(request[n:])
+	ts := decodeTimeSeries(t, field)
+
+	expected := decodedSeries{
+		labels:  []string{"__name__=aws_cost", "timestamp=daily"},
+		samples: []timedSample{{1, at.UnixMilli()}},
+	}
+
+	if !reflect.DeepEqual(ts, expected) {
+		t.Errorf("series = %v, expected %v", ts, expected)
+	}
+}
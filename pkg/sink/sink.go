@@ -0,0 +1,32 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Sink receives metrics after each successful computation,
+// in addition to them being served by the exporter
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, gatherer prometheus.Gatherer) error
+}
+
+// WithoutTimestamps drops explicit timestamps of samples for consumers
+// rejecting them, i.e. Pushgateway and node_exporter textfile collector,
+// so samples of queries with timestamp_ column get the time of gathering
+func WithoutTimestamps(gatherer prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := gatherer.Gather()
+
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				m.TimestampMs = nil
+			}
+		}
+
+		return mfs, err
+	})
+}
@@ -0,0 +1,46 @@
+package sink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWithoutTimestamps(t *testing.T) {
+	desc := prometheus.NewDesc("aws_cost", "Cost.", []string{"day"}, nil)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- prometheus.NewMetricWithTimestamp(
+			time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+			prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, "2023-10-01"),
+		)
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2, "2023-10-02")
+	}))
+
+	mfs, err := WithoutTimestamps(registry).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mfs) != 1 || len(mfs[0].Metric) != 2 {
+		t.Fatalf("gathered %v, expected 2 samples", mfs)
+	}
+
+	for _, m := range mfs[0].Metric {
+		if m.TimestampMs != nil {
+			t.Errorf("sample %v has timestamp", m)
+		}
+	}
+}
+
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(f, ch)
+}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
@@ -0,0 +1,136 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Backend stores serialized state between restarts of the exporter
+type Backend interface {
+	Name() string
+
+	// Read returns stored state, or nil if nothing is stored yet
+	Read() ([]byte, error)
+
+	// Write replaces stored state. Backends which support it reject
+	// writes with ConflictError if state was modified since it was read,
+	// and keep rejecting them until the state is read again
+	Write(data []byte) error
+}
+
+// ConflictError is returned by Write if state was modified
+// by another writer since the backend read it
+type ConflictError struct {
+	Backend string
+	Err     error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("state in %s was modified by another writer: %v", e.Backend, e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// backupReader is implemented by backends keeping the previous state,
+// which is loaded if the current one is corrupted
+type backupReader interface {
+	ReadBackup() ([]byte, error)
+}
+
+// FileBackend stores state in a local file, which is replaced atomically.
+// The previous state is kept as a backup to recover from corruption
+// of the file itself, e.g. by a full disk or a faulty volume
+type FileBackend struct {
+	path string
+}
+
+func NewFileBackend(path string) *FileBackend {
+	return &FileBackend{path}
+}
+
+func (b *FileBackend) Name() string {
+	return "file " + b.path
+}
+
+func (b *FileBackend) Read() ([]byte, error) {
+	return readFile(b.path)
+}
+
+func (b *FileBackend) ReadBackup() ([]byte, error) {
+	return readFile(backupPath(b.path))
+}
+
+func (b *FileBackend) Write(data []byte) error {
+	if previous, err := os.ReadFile(b.path); err == nil {
+		if json.Valid(previous) {
+			if err := writeFile(backupPath(b.path), previous); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return writeFile(b.path, data)
+}
+
+func backupPath(path string) string {
+	return path + ".bak"
+}
+
+func readFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return data, err
+}
+
+// Writes data to a temporary file in the same directory
+// and renames it over the target once it is synced to disk
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Chmod(0640); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
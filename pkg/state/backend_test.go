@@ -0,0 +1,139 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+)
+
+func TestFileBackendWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	backend := NewFileBackend(path)
+
+	expectFile := func(path string, expected string) {
+		t.Helper()
+
+		data, err := os.ReadFile(path)
+		if expected == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s exists, expected no file", filepath.Base(path))
+			}
+			return
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("%s contains %q, expected %q", filepath.Base(path), data, expected)
+		}
+	}
+
+	if err := backend.Write([]byte(`{"version":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(path, `{"version":"1"}`)
+	expectFile(backupPath(path), "")
+
+	if err := backend.Write([]byte(`{"version":"2"}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(path, `{"version":"2"}`)
+	expectFile(backupPath(path), `{"version":"1"}`)
+
+	// A corrupted state must not replace a good backup
+	if err := os.WriteFile(path, []byte(`{"vers`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Write([]byte(`{"version":"3"}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(path, `{"version":"3"}`)
+	expectFile(backupPath(path), `{"version":"1"}`)
+
+	// Temporary files are renamed or removed
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Errorf("directory contains %d files, expected only state and its backup", len(items))
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("state has mode %v, expected 0640", info.Mode().Perm())
+	}
+}
+
+func TestFileBackendWriteFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "state.json")
+
+	if err := NewFileBackend(path).Write([]byte(`{}`)); err == nil {
+		t.Fatal("Write() to missing directory succeeded")
+	}
+}
+
+func TestLoadCorrupted(t *testing.T) {
+	backup := `{"version":"5","BillingPeriod":["20231001-20231101"]}`
+
+	cases := []struct {
+		name    string
+		state   string
+		backup  string
+		periods int
+		err     bool
+	}{
+		{"truncated", `{"version":"5","Billing`, backup, 1, false},
+		{"wrong type", `{"version":"5","reportHash":[]}`, backup, 1, false},
+		{"invalid version", `{"version":"five"}`, backup, 1, false},
+		{"invalid period", `{"version":"5","BillingPeriod":["2023"]}`, backup, 1, false},
+		{"not an object", `[]`, backup, 1, false},
+		{"corrupted backup", `{`, `{`, 0, false},
+		{"missing backup", `{`, "", 0, false},
+		{"newer version", `{"version":"99"}`, backup, 0, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := &Config{
+				RepositoryPath: filepath.Join(dir, "repository"),
+				QueriesPath:    dir,
+				StateFilePath:  filepath.Join(dir, "state.json"),
+			}
+
+			if err := os.WriteFile(config.StateFilePath, []byte(c.state), 0640); err != nil {
+				t.Fatal(err)
+			}
+			if c.backup != "" {
+				if err := os.WriteFile(backupPath(config.StateFilePath), []byte(c.backup), 0640); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state, err := Load(config, log.NewNopLogger())
+			if c.err {
+				var versionErr *VersionError
+				if !errors.As(err, &versionErr) {
+					t.Fatalf("Load() = %v, expected VersionError", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state.Periods) != c.periods {
+				t.Errorf("loaded %d periods, expected %d", len(state.Periods), c.periods)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/st8ed/aws-cost-exporter/pkg/kubernetes"
+)
+
+// Kinds of Kubernetes objects state can be stored in
+const (
+	KindConfigMap = "configmap"
+	KindSecret    = "secret"
+)
+
+// Key of the object data holding state
+const kubernetesDataKey = "state.json"
+
+// KubernetesBackend stores state in a ConfigMap or Secret using credentials
+// of the pod service account. Writes carry resourceVersion of the object
+// read last, so concurrent writers don't overwrite each other
+type KubernetesBackend struct {
+	client    *kubernetes.Client
+	kind      string
+	namespace string
+	name      string
+
+	mu sync.Mutex
+	// Empty if the object doesn't exist
+	resourceVersion string
+}
+
+// Fields of ConfigMap and Secret used by the backend
+type kubernetesConfigMap struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Metadata   kubernetes.ObjectMeta `json:"metadata"`
+	Data       map[string]string     `json:"data,omitempty"`
+}
+
+// Data of Secrets is base64-encoded, which json does for []byte
+type kubernetesSecret struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Metadata   kubernetes.ObjectMeta `json:"metadata"`
+	Data       map[string][]byte     `json:"data,omitempty"`
+}
+
+// NewKubernetesBackend returns backend storing state in the object of given
+// kind in the namespace, the namespace of the pod is used if it is empty
+func NewKubernetesBackend(kind string, namespace string, name string) (*KubernetesBackend, error) {
+	if kind != KindConfigMap && kind != KindSecret {
+		return nil, fmt.Errorf("unknown kind of Kubernetes object: %s", kind)
+	}
+
+	client, err := kubernetes.NewInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if namespace == "" {
+		namespace = client.Namespace
+	}
+
+	return &KubernetesBackend{
+		client:    client,
+		kind:      kind,
+		namespace: namespace,
+		name:      name,
+	}, nil
+}
+
+func (b *KubernetesBackend) Name() string {
+	return fmt.Sprintf("%s %s/%s", b.kind, b.namespace, b.name)
+}
+
+func (b *KubernetesBackend) Read() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.read()
+}
+
+// Reads the object and remembers its resourceVersion, b.mu must be held
+func (b *KubernetesBackend) read() ([]byte, error) {
+	var (
+		meta *kubernetes.ObjectMeta
+		data []byte
+		err  error
+	)
+
+	if b.kind == KindSecret {
+		object := &kubernetesSecret{}
+		err = b.client.Do(context.TODO(), http.MethodGet, b.objectPath(), nil, object)
+		meta, data = &object.Metadata, object.Data[kubernetesDataKey]
+	} else {
+		object := &kubernetesConfigMap{}
+		err = b.client.Do(context.TODO(), http.MethodGet, b.objectPath(), nil, object)
+		if value, ok := object.Data[kubernetesDataKey]; ok {
+			data = []byte(value)
+		}
+		meta = &object.Metadata
+	}
+
+	if kubernetes.IsNotFound(err) {
+		b.resourceVersion = ""
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	b.resourceVersion = meta.ResourceVersion
+
+	return data, nil
+}
+
+func (b *KubernetesBackend) Write(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	meta := kubernetes.ObjectMeta{
+		Name:            b.name,
+		Namespace:       b.namespace,
+		ResourceVersion: b.resourceVersion,
+	}
+
+	var request interface{}
+	if b.kind == KindSecret {
+		request = &kubernetesSecret{"v1", "Secret", meta, map[string][]byte{kubernetesDataKey: data}}
+	} else {
+		request = &kubernetesConfigMap{"v1", "ConfigMap", meta, map[string]string{kubernetesDataKey: string(data)}}
+	}
+
+	// Object is replaced only if its resourceVersion matches
+	// and created only if it doesn't exist
+	method, path := http.MethodPut, b.objectPath()
+	if b.resourceVersion == "" {
+		method, path = http.MethodPost, b.collectionPath()
+	}
+
+	response := &struct {
+		Metadata kubernetes.ObjectMeta `json:"metadata"`
+	}{}
+
+	err := b.client.Do(context.TODO(), method, path, request, response)
+	if kubernetes.IsConflict(err) {
+		return &ConflictError{b.Name(), err}
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", b.Name(), err)
+	}
+
+	b.resourceVersion = response.Metadata.ResourceVersion
+
+	return nil
+}
+
+func (b *KubernetesBackend) collectionPath() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/%ss", b.namespace, b.kind)
+}
+
+func (b *KubernetesBackend) objectPath() string {
+	return b.collectionPath() + "/" + b.name
+}
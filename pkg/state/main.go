@@ -2,18 +2,40 @@ package state
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"path/filepath"
-
+	"errors"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 )
 
 type State struct {
+	// Guards concurrent access from web handlers,
+	// all writes happen from the refresh loop
+	sync.RWMutex `json:"-"`
+
 	Version            string               `json:"version"`
 	ReportLastModified map[string]time.Time `json:"reportLastModified"`
+	ReportAssemblyId   map[string]string    `json:"reportAssemblyId"`
+
+	// SHA-256 of report file, queries are rerun only when it changes
+	ReportHash map[string]string `json:"reportHash"`
+
+	// Invoice ID found in report, empty until AWS finalizes the period
+	ReportInvoiceId map[string]string `json:"reportInvoiceId"`
 
-	Periods []BillingPeriod `json:"BillingPeriod"`
+	// Assembly whose report was looked up for invoice ID,
+	// so each assembly of a period is scanned only once
+	ReportInvoiceAssemblyId map[string]string `json:"reportInvoiceAssemblyId"`
+
+	// Details of the last downloaded report manifest
+	ReportManifest map[string]*ManifestInfo `json:"reportManifest"`
+
+	Periods []BillingPeriod         `json:"BillingPeriod"`
+	Queries map[string]*QueryStatus `json:"queries"`
 }
 
 type Config struct {
@@ -22,26 +44,80 @@ type Config struct {
 	BucketName     string
 	ReportName     string
 
+	// Variables available to query templates
+	QueryVariables map[string]string
+
+	// SQL engine to run queries with, csvq if empty
+	QueryEngine string
+
+	// Reuse results of queries whose inputs didn't change
+	QueryCache bool
+
+	// Dimensions of rollups by name
+	Rollups map[string][]string
+
+	// How long after the end of a billing period its report
+	// is checked for updates until AWS finalizes it
+	FinalizationGrace time.Duration
+
 	StateFilePath string
+
+	// Where state is stored, file at StateFilePath if nil
+	StateBackend Backend
+}
+
+// Backend returns where state is stored
+func (config *Config) Backend() Backend {
+	if config.StateBackend != nil {
+		return config.StateBackend
+	}
+
+	return NewFileBackend(config.StateFilePath)
 }
 
 func Init() *State {
 	return &State{
-		Version:            "1",
-		ReportLastModified: map[string]time.Time{},
+		Version:                 Version,
+		ReportLastModified:      map[string]time.Time{},
+		ReportAssemblyId:        map[string]string{},
+		ReportHash:              map[string]string{},
+		ReportInvoiceId:         map[string]string{},
+		ReportInvoiceAssemblyId: map[string]string{},
+		ReportManifest:          map[string]*ManifestInfo{},
+		Queries:                 map[string]*QueryStatus{},
 	}
 }
 
-func Load(config *Config) (*State, error) {
-	state := Init()
+func Load(config *Config, logger log.Logger) (*State, error) {
+	backend := config.Backend()
 
-	if jsonString, err := ioutil.ReadFile(config.StateFilePath); err != nil {
-		if !os.IsNotExist(err) {
+	data, err := backend.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := decode(data, backend, logger)
+	if err != nil {
+		// State of a newer exporter isn't corrupted, replacing
+		// it would lose what that exporter stored
+		var versionErr *VersionError
+		if errors.As(err, &versionErr) {
 			return nil, err
 		}
-	} else {
-		if err := json.Unmarshal(jsonString, state); err != nil {
-			return nil, err
+
+		// A corrupted state only costs refetching reports,
+		// so it shouldn't prevent the exporter from starting
+		state = Init()
+
+		if b, ok := backend.(backupReader); ok {
+			level.Warn(logger).Log("msg", "State is corrupted, loading backup", "backend", backend.Name(), "err", err)
+
+			if state, err = decodeBackup(b, backend, logger); err != nil {
+				level.Warn(logger).Log("msg", "Unable to load backup of state, starting with empty state", "backend", backend.Name(), "err", err)
+				state = Init()
+			}
+		} else {
+			level.Warn(logger).Log("msg", "State is corrupted, starting with empty state", "backend", backend.Name(), "err", err)
 		}
 	}
 
@@ -60,14 +136,67 @@ func Load(config *Config) (*State, error) {
 	return state, nil
 }
 
-func (state *State) Save(config *Config) error {
-	if jsonString, err := json.MarshalIndent(state, "", "    "); err != nil {
+func decodeBackup(b backupReader, backend Backend, logger log.Logger) (*State, error) {
+	data, err := b.ReadBackup()
+	if err != nil {
+		return nil, err
+	}
+
+	return decode(data, backend, logger)
+}
+
+// Returns empty state if nothing is stored
+func decode(jsonString []byte, backend Backend, logger log.Logger) (*State, error) {
+	if jsonString == nil {
+		return Init(), nil
+	}
+
+	state, version, err := Decode(jsonString)
+	if err != nil {
+		return nil, err
+	}
+
+	if version != Version {
+		level.Info(logger).Log("msg", "Migrated state to the current version", "backend", backend.Name(), "from", version, "to", Version)
+	}
+
+	return state, nil
+}
+
+// Reload replaces state with the stored one,
+// which may have been saved by another replica
+func (state *State) Reload(config *Config, logger log.Logger) error {
+	loaded, err := Load(config, logger)
+	if err != nil {
 		return err
-	} else {
-		if err := ioutil.WriteFile(config.StateFilePath, jsonString, os.ModePerm); err != nil {
-			return err
-		}
 	}
 
+	state.Lock()
+	defer state.Unlock()
+
+	state.Version = loaded.Version
+	state.ReportLastModified = loaded.ReportLastModified
+	state.ReportAssemblyId = loaded.ReportAssemblyId
+	state.ReportHash = loaded.ReportHash
+	state.ReportInvoiceId = loaded.ReportInvoiceId
+	state.ReportInvoiceAssemblyId = loaded.ReportInvoiceAssemblyId
+	state.ReportManifest = loaded.ReportManifest
+	state.Periods = loaded.Periods
+	state.Queries = loaded.Queries
+
 	return nil
 }
+
+func (state *State) Save(config *Config) error {
+	state.RLock()
+	jsonString, err := json.MarshalIndent(state, "", "    ")
+	state.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	// State saved by another writer since it was loaded isn't overwritten,
+	// ConflictError is returned and the state has to be reloaded
+	return config.Backend().Write(jsonString)
+}
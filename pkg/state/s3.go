@@ -0,0 +1,119 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// S3Backend stores state in an S3 object. Writes are conditional on ETag
+// of the object read last, so concurrent writers don't overwrite each other
+type S3Backend struct {
+	client *s3.Client
+	bucket string
+	key    string
+
+	mu sync.Mutex
+	// ETag of the stored object, empty if it doesn't exist
+	etag string
+}
+
+// NewS3Backend returns backend storing state at URL like s3://bucket/path/state.json
+func NewS3Backend(client *s3.Client, rawURL string) (*S3Backend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "s3" || u.Host == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL of state, expected s3://<bucket>/<key>: %s", rawURL)
+	}
+
+	return &S3Backend{
+		client: client,
+		bucket: u.Host,
+		key:    key,
+	}, nil
+}
+
+func (b *S3Backend) Name() string {
+	return fmt.Sprintf("s3://%s/%s", b.bucket, b.key)
+}
+
+func (b *S3Backend) Read() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.read()
+}
+
+// Reads the object and remembers its ETag, b.mu must be held
+func (b *S3Backend) read() ([]byte, error) {
+	obj, err := b.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key),
+	})
+	if err != nil {
+		var ae smithy.APIError
+
+		if errors.As(err, &ae) && ae.ErrorCode() == "NoSuchKey" {
+			b.etag = ""
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	b.etag = aws.ToString(obj.ETag)
+
+	return data, nil
+}
+
+func (b *S3Backend) Write(data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The SDK has no fields for conditional writes yet, so headers
+	// are set directly. Object is created only if it doesn't exist
+	condition := smithyhttp.SetHeaderValue("If-None-Match", "*")
+	if b.etag != "" {
+		condition = smithyhttp.SetHeaderValue("If-Match", b.etag)
+	}
+
+	obj, err := b.client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(b.key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}, s3.WithAPIOptions(condition))
+	if err != nil {
+		var ae smithy.APIError
+
+		if errors.As(err, &ae) && (ae.ErrorCode() == "PreconditionFailed" || ae.ErrorCode() == "ConditionalRequestConflict") {
+			return &ConflictError{b.Name(), err}
+		}
+
+		return err
+	}
+
+	b.etag = aws.ToString(obj.ETag)
+
+	return nil
+}
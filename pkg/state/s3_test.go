@@ -0,0 +1,240 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-kit/log"
+)
+
+// Serves a single object with conditional writes like S3 does
+type fakeS3 struct {
+	mu      sync.Mutex
+	data    []byte
+	version int
+}
+
+func (f *fakeS3) etag() string {
+	return fmt.Sprintf("\"%d\"", f.version)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fail := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if f.data == nil {
+			fail(http.StatusNotFound, "NoSuchKey")
+			return
+		}
+
+		w.Header().Set("ETag", f.etag())
+		w.Write(f.data)
+
+	case http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && (f.data == nil || match != f.etag()) {
+			fail(http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == "*" && f.data != nil {
+			fail(http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			fail(http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+
+		f.data = data
+		f.version++
+
+		w.Header().Set("ETag", f.etag())
+
+	default:
+		fail(http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func newTestS3Backend(t *testing.T, url string) *S3Backend {
+	t.Helper()
+
+	client := s3.New(s3.Options{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("key", "secret", ""),
+		EndpointResolver: s3.EndpointResolverFromURL(url),
+		UsePathStyle:     true,
+		RetryMaxAttempts: 1,
+	})
+
+	backend, err := NewS3Backend(client, "s3://bucket/path/state.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return backend
+}
+
+func TestNewS3Backend(t *testing.T) {
+	for _, url := range []string{"s3://bucket", "s3://bucket/", "s3:///key", "https://bucket/key"} {
+		if _, err := NewS3Backend(nil, url); err == nil {
+			t.Errorf("NewS3Backend(%q) succeeded, expected error", url)
+		}
+	}
+}
+
+func TestS3BackendReadWrite(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{})
+	defer server.Close()
+
+	backend := newTestS3Backend(t, server.URL)
+
+	data, err := backend.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != nil {
+		t.Fatalf("Read() = %q, expected nil for missing object", data)
+	}
+
+	for _, expected := range []string{`{"version":"1"}`, `{"version":"2"}`} {
+		if err := backend.Write([]byte(expected)); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := backend.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Errorf("Read() = %q, expected %q", data, expected)
+		}
+	}
+}
+
+func TestS3BackendConflict(t *testing.T) {
+	for _, exists := range []bool{false, true} {
+		t.Run(fmt.Sprintf("exists=%v", exists), func(t *testing.T) {
+			fake := &fakeS3{}
+			if exists {
+				fake.data, fake.version = []byte(`{}`), 1
+			}
+
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			a, b := newTestS3Backend(t, server.URL), newTestS3Backend(t, server.URL)
+
+			for _, backend := range []*S3Backend{a, b} {
+				if _, err := backend.Read(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := b.Write([]byte(`"b"`)); err != nil {
+				t.Fatal(err)
+			}
+
+			var conflict *ConflictError
+			if err := a.Write([]byte(`"a"`)); !errors.As(err, &conflict) {
+				t.Fatalf("Write() = %v, expected ConflictError", err)
+			}
+
+			// Writes are rejected until the backend reads the state again
+			if err := a.Write([]byte(`"a"`)); !errors.As(err, &conflict) {
+				t.Fatalf("Write() after conflict = %v, expected ConflictError", err)
+			}
+
+			if string(fake.data) != `"b"` {
+				t.Errorf("stored %q, expected %q", fake.data, `"b"`)
+			}
+
+			if _, err := a.Read(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := a.Write([]byte(`"a"`)); err != nil {
+				t.Fatalf("Write() after read = %v", err)
+			}
+
+			if string(fake.data) != `"a"` {
+				t.Errorf("stored %q, expected %q", fake.data, `"a"`)
+			}
+		})
+	}
+}
+
+func TestSaveConflict(t *testing.T) {
+	fake := &fakeS3{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	a, b := newTestS3Backend(t, server.URL), newTestS3Backend(t, server.URL)
+	config := &Config{StateBackend: a, RepositoryPath: t.TempDir(), QueriesPath: t.TempDir()}
+
+	state := Init()
+	if err := state.Save(config); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance saves state with a known report
+	if _, err := b.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	other := Init()
+	other.ReportAssemblyId["20231001-20231101"] = "b"
+
+	if err := other.Save(&Config{StateBackend: b}); err != nil {
+		t.Fatal(err)
+	}
+
+	state.ReportAssemblyId["20231001-20231101"] = "a"
+
+	var conflict *ConflictError
+	if err := state.Save(config); !errors.As(err, &conflict) {
+		t.Fatalf("Save() after concurrent write = %v, expected ConflictError", err)
+	}
+
+	if err := state.Save(config); !errors.As(err, &conflict) {
+		t.Fatalf("second Save() after concurrent write = %v, expected ConflictError", err)
+	}
+
+	stored, _, err := Decode(fake.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assemblyId := stored.ReportAssemblyId["20231001-20231101"]; assemblyId != "b" {
+		t.Errorf("stored assembly %q, expected state of the other instance to be kept", assemblyId)
+	}
+
+	// Once reloaded, state of the other instance can be replaced
+	if err := state.Reload(config, log.NewNopLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	if assemblyId := state.ReportAssemblyId["20231001-20231101"]; assemblyId != "b" {
+		t.Errorf("reloaded assembly %q, expected %q", assemblyId, "b")
+	}
+
+	if err := state.Save(config); err != nil {
+		t.Fatalf("Save() after reload = %v", err)
+	}
+}
@@ -1,42 +1,91 @@
 package state
 
 import (
-	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 )
 
-type BillingPeriod string
+// BillingPeriod is a calendar month covered by reports, from
+// the start inclusive to the end exclusive, both in UTC
+type BillingPeriod struct {
+	Start time.Time
+	End   time.Time
+}
 
-func ParseBillingPeriod(period string) (*BillingPeriod, error) {
-	p := BillingPeriod(period) // TODO: Validation
-	return &p, nil
+// Layout of dates in billing period names
+const billingPeriodLayout = "20060102"
+
+// ManifestInfo describes the report manifest of a billing period
+type ManifestInfo struct {
+	// Billing period as stated by the manifest
+	BillingPeriodStart time.Time `json:"billingPeriodStart"`
+	BillingPeriodEnd   time.Time `json:"billingPeriodEnd"`
+
+	Compression string `json:"compression"`
+	Parts       int    `json:"parts"`
+	Columns     int    `json:"columns"`
 }
 
-func (period *BillingPeriod) IsPastDue() bool {
-	parts := strings.Split(string(*period), "-")
-	if len(parts) != 2 || len(parts[1]) != 8 {
-		panic(fmt.Sprintf("Malformed period format: %s", *period))
+type QueryStatus struct {
+	LastRun   time.Time     `json:"lastRun"`
+	Duration  time.Duration `json:"duration"`
+	Rows      int           `json:"rows"`
+	Cached    bool          `json:"cached"`
+	LastError string        `json:"lastError,omitempty"`
+
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// ParseBillingPeriod parses period named like 20231001-20231101,
+// as prefixes of reports in the bucket are. Dates are in UTC
+func ParseBillingPeriod(period string) (*BillingPeriod, error) {
+	parts := strings.Split(period, "-")
+	if len(parts) != 2 || len(parts[0]) != len(billingPeriodLayout) || len(parts[1]) != len(billingPeriodLayout) {
+		return nil, fmt.Errorf("malformed billing period, expected YYYYMMDD-YYYYMMDD: %q", period)
+	}
+
+	start, err := time.ParseInLocation(billingPeriodLayout, parts[0], time.UTC)
+	if err != nil {
+		return nil, fmt.Errorf("malformed start of billing period %q: %w", period, err)
 	}
 
-	// TODO: Make sure reports timezone is actually UTC
-	t, err := time.ParseInLocation("20060102", parts[1], time.UTC)
+	end, err := time.ParseInLocation(billingPeriodLayout, parts[1], time.UTC)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("malformed end of billing period %q: %w", period, err)
 	}
 
-	return t.Before(time.Now())
+	// Reports cover calendar months
+	if start.Day() != 1 || !end.Equal(start.AddDate(0, 1, 0)) {
+		return nil, fmt.Errorf("billing period is not a calendar month: %q", period)
+	}
+
+	return &BillingPeriod{Start: start, End: end}, nil
 }
 
-func (period *BillingPeriod) UnmarshalJSON(bytes []byte) error {
-	var s string
+func (period BillingPeriod) String() string {
+	return period.Start.Format(billingPeriodLayout) + "-" + period.End.Format(billingPeriodLayout)
+}
 
-	if err := json.Unmarshal(bytes, &s); err != nil {
-		return err
-	}
-	p, err := ParseBillingPeriod(s)
+// IsPastDue tells whether the period ended. AWS bills in UTC, so periods
+// end at midnight UTC, but reports of the period are still updated until
+// AWS finalizes them, see WithinGrace
+func (period *BillingPeriod) IsPastDue() bool {
+	return period.End.Before(time.Now())
+}
+
+// WithinGrace tells whether the period ended less than grace ago
+func (period *BillingPeriod) WithinGrace(grace time.Duration) bool {
+	return period.IsPastDue() && time.Now().Before(period.End.Add(grace))
+}
+
+// Periods are stored in state in the same format as they are named in the bucket
+func (period BillingPeriod) MarshalText() ([]byte, error) {
+	return []byte(period.String()), nil
+}
 
+func (period *BillingPeriod) UnmarshalText(text []byte) error {
+	p, err := ParseBillingPeriod(string(text))
 	if err != nil {
 		return err
 	}
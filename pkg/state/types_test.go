@@ -0,0 +1,131 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseBillingPeriod(t *testing.T) {
+	valid := map[string][2]time.Time{
+		"20231001-20231101": {time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)},
+		"20231201-20240101": {time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"20240201-20240301": {time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for text, expected := range valid {
+		period, err := ParseBillingPeriod(text)
+		if err != nil {
+			t.Errorf("ParseBillingPeriod(%q): %v", text, err)
+			continue
+		}
+
+		if !period.Start.Equal(expected[0]) || !period.End.Equal(expected[1]) || period.Start.Location() != time.UTC {
+			t.Errorf("ParseBillingPeriod(%q) = %v - %v, expected %v - %v", text, period.Start, period.End, expected[0], expected[1])
+		}
+
+		if period.String() != text {
+			t.Errorf("String() = %q, expected %q", period.String(), text)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"20231001",
+		"20231001-",
+		"20231001-20231101-20231201",
+		"2023101-20231101",
+		"20231001-2023111",
+		"2023-10-01-2023-11-01",
+		"20231301-20240101",
+		"2023100a-20231101",
+		"20231002-20231102",
+		"20231001-20231201",
+		"20231101-20231001",
+		"20231001-20231001",
+		"metadata",
+	}
+
+	for _, text := range invalid {
+		if period, err := ParseBillingPeriod(text); err == nil {
+			t.Errorf("ParseBillingPeriod(%q) = %v, expected error", text, period)
+		}
+	}
+}
+
+func TestBillingPeriodText(t *testing.T) {
+	periods := []BillingPeriod{
+		{time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	data, err := json.Marshal(periods)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := `["20231001-20231101","20231101-20231201"]`; string(data) != expected {
+		t.Errorf("Marshal() = %s, expected %s", data, expected)
+	}
+
+	decoded := []BillingPeriod{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range periods {
+		if !decoded[i].Start.Equal(periods[i].Start) || !decoded[i].End.Equal(periods[i].End) {
+			t.Errorf("Unmarshal() = %v, expected %v", decoded, periods)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`["2023"]`), &decoded); err == nil {
+		t.Error("Unmarshal() of malformed period succeeded")
+	}
+}
+
+func TestIsPastDue(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name    string
+		end     time.Time
+		pastDue bool
+	}{
+		{"ended", now.Add(-time.Minute), true},
+		{"ending", now.Add(time.Minute), false},
+		{"ended long ago", time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, c := range cases {
+		period := BillingPeriod{Start: c.end.AddDate(0, -1, 0), End: c.end}
+
+		if pastDue := period.IsPastDue(); pastDue != c.pastDue {
+			t.Errorf("%s: IsPastDue() = %v, expected %v", c.name, pastDue, c.pastDue)
+		}
+	}
+}
+
+func TestWithinGrace(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		end    time.Time
+		grace  time.Duration
+		within bool
+	}{
+		{"not ended", now.Add(time.Hour), 24 * time.Hour, false},
+		{"ended within grace", now.Add(-time.Hour), 24 * time.Hour, true},
+		{"ended before grace", now.Add(-25 * time.Hour), 24 * time.Hour, false},
+		{"without grace", now.Add(-time.Hour), 0, false},
+	}
+
+	for _, c := range cases {
+		period := BillingPeriod{Start: c.end.AddDate(0, -1, 0), End: c.end}
+
+		if within := period.WithinGrace(c.grace); within != c.within {
+			t.Errorf("%s: WithinGrace(%v) = %v, expected %v", c.name, c.grace, within, c.within)
+		}
+	}
+}
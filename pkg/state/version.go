@@ -0,0 +1,166 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Version of state schema written by this build. Increment it along with
+// adding a migration whenever fields are renamed or change their meaning
+const Version = "6"
+
+// Migrations upgrade decoded JSON document of state by one version,
+// the migration at index i upgrades version i+1 to i+2
+var migrations = []func(document map[string]json.RawMessage) error{
+	// Version 2 tracks assembly IDs and hashes of reports and runs
+	// of queries, reports of version 1 are rehashed on next update
+	func(document map[string]json.RawMessage) error {
+		for _, key := range []string{"reportAssemblyId", "reportHash", "queries"} {
+			if value, ok := document[key]; !ok || string(value) == "null" {
+				document[key] = json.RawMessage("{}")
+			}
+		}
+
+		return nil
+	},
+
+	// Version 3 validates billing periods. Older builds listed any prefix
+	// of the bucket as a period, such prefixes are dropped
+	func(document map[string]json.RawMessage) error {
+		if value, ok := document["BillingPeriod"]; ok && string(value) != "null" {
+			periods := []string{}
+			if err := json.Unmarshal(value, &periods); err != nil {
+				return err
+			}
+
+			valid := make([]string, 0, len(periods))
+			for _, period := range periods {
+				if _, err := ParseBillingPeriod(period); err == nil {
+					valid = append(valid, period)
+				}
+			}
+
+			value, err := json.Marshal(valid)
+			if err != nil {
+				return err
+			}
+
+			document["BillingPeriod"] = value
+		}
+
+		for _, key := range []string{"reportLastModified", "reportAssemblyId", "reportHash"} {
+			value, ok := document[key]
+			if !ok || string(value) == "null" {
+				continue
+			}
+
+			byPeriod := map[string]json.RawMessage{}
+			if err := json.Unmarshal(value, &byPeriod); err != nil {
+				return err
+			}
+
+			for period := range byPeriod {
+				if _, err := ParseBillingPeriod(period); err != nil {
+					delete(byPeriod, period)
+				}
+			}
+
+			value, err := json.Marshal(byPeriod)
+			if err != nil {
+				return err
+			}
+
+			document[key] = value
+		}
+
+		return nil
+	},
+
+	// Version 4 tracks invoice IDs of reports, reports
+	// of version 3 are checked for them on start
+	func(document map[string]json.RawMessage) error {
+		if value, ok := document["reportInvoiceId"]; !ok || string(value) == "null" {
+			document["reportInvoiceId"] = json.RawMessage("{}")
+		}
+
+		return nil
+	},
+
+	// Version 5 keeps details of report manifests, manifests
+	// of version 4 are downloaded again on start
+	func(document map[string]json.RawMessage) error {
+		if value, ok := document["reportManifest"]; !ok || string(value) == "null" {
+			document["reportManifest"] = json.RawMessage("{}")
+		}
+
+		return nil
+	},
+
+	// Version 6 tracks which assemblies were looked up for invoice IDs,
+	// reports of version 5 without invoice ID are scanned once on start
+	func(document map[string]json.RawMessage) error {
+		if value, ok := document["reportInvoiceAssemblyId"]; !ok || string(value) == "null" {
+			document["reportInvoiceAssemblyId"] = json.RawMessage("{}")
+		}
+
+		return nil
+	},
+}
+
+// VersionError is returned for state written by a newer build of the
+// exporter, it may have fields this build would silently drop on save
+type VersionError struct {
+	Version string
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("state version %s is newer than supported version %s, upgrade the exporter or remove the state", e.Version, Version)
+}
+
+// Decode parses state of any supported version and migrates
+// it to the current one. It returns the version found in data
+func Decode(data []byte) (*State, string, error) {
+	document := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, "", err
+	}
+
+	// Version was always written, but treat its absence as the first one
+	version := "1"
+	if value, ok := document["version"]; ok {
+		if err := json.Unmarshal(value, &version); err != nil {
+			return nil, "", fmt.Errorf("invalid state version: %s", value)
+		}
+	}
+
+	from, err := strconv.Atoi(version)
+	if err != nil || from < 1 {
+		return nil, "", fmt.Errorf("invalid state version: %s", version)
+	}
+
+	if from > len(migrations)+1 {
+		return nil, "", &VersionError{version}
+	}
+
+	for _, migrate := range migrations[from-1:] {
+		if err := migrate(document); err != nil {
+			return nil, "", fmt.Errorf("migrate state from version %d: %w", from, err)
+		}
+		from++
+	}
+
+	document["version"] = json.RawMessage(strconv.Quote(Version))
+
+	migrated, err := json.Marshal(document)
+	if err != nil {
+		return nil, "", err
+	}
+
+	state := Init()
+	if err := json.Unmarshal(migrated, state); err != nil {
+		return nil, "", err
+	}
+
+	return state, version, nil
+}
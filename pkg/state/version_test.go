@@ -0,0 +1,114 @@
+package state
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDecodeMigrations(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    string
+		version string
+	}{
+		{
+			"version 1 without version field",
+			`{"reportLastModified":{"20231001-20231101":"2023-11-05T12:00:00Z","metadata":"2023-11-05T12:00:00Z"},"BillingPeriod":["20231001-20231101","metadata"]}`,
+			"1",
+		},
+		{
+			"version 1",
+			`{"version":"1","reportLastModified":{"20231001-20231101":"2023-11-05T12:00:00Z"},"BillingPeriod":["20231001-20231101"]}`,
+			"1",
+		},
+		{
+			"version 2",
+			`{"version":"2","reportLastModified":{"20231001-20231101":"2023-11-05T12:00:00Z"},"reportAssemblyId":{"20231001-20231101":"abc","stray":"def"},"reportHash":{},"queries":{},"BillingPeriod":["20231001-20231101","stray"]}`,
+			"2",
+		},
+		{
+			"version 3",
+			`{"version":"3","reportLastModified":{"20231001-20231101":"2023-11-05T12:00:00Z"},"reportAssemblyId":{"20231001-20231101":"abc"},"reportHash":{},"queries":{},"BillingPeriod":["20231001-20231101"]}`,
+			"3",
+		},
+		{
+			"version 4",
+			`{"version":"4","reportLastModified":{"20231001-20231101":"2023-11-05T12:00:00Z"},"reportAssemblyId":{"20231001-20231101":"abc"},"reportHash":{},"reportInvoiceId":{},"queries":{},"BillingPeriod":["20231001-20231101"]}`,
+			"4",
+		},
+		{
+			"version 5",
+			`{"version":"5","reportLastModified":{"20231001-20231101":"2023-11-05T12:00:00Z"},"reportAssemblyId":{"20231001-20231101":"abc"},"reportHash":{},"reportInvoiceId":{},"reportManifest":{},"queries":{},"BillingPeriod":["20231001-20231101"]}`,
+			"5",
+		},
+		{
+			"version 6",
+			`{"version":"6","reportLastModified":{"20231001-20231101":"2023-11-05T12:00:00Z"},"reportAssemblyId":{"20231001-20231101":"abc"},"reportHash":{},"reportInvoiceId":{},"reportInvoiceAssemblyId":{},"reportManifest":{},"queries":{},"BillingPeriod":["20231001-20231101"]}`,
+			"6",
+		},
+	}
+
+	for _, c := range cases {
+		state, version, err := Decode([]byte(c.data))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+
+		if version != c.version {
+			t.Errorf("%s: version %q, expected %q", c.name, version, c.version)
+		}
+
+		if state.Version != Version {
+			t.Errorf("%s: migrated to version %q, expected %q", c.name, state.Version, Version)
+		}
+
+		// Maps added by migrations are never nil, so they can be written
+		if state.ReportAssemblyId == nil || state.ReportHash == nil || state.ReportInvoiceId == nil || state.ReportInvoiceAssemblyId == nil || state.ReportManifest == nil || state.Queries == nil {
+			t.Errorf("%s: migrated state has nil maps: %+v", c.name, state)
+		}
+
+		if len(state.Periods) != 1 || state.Periods[0].String() != "20231001-20231101" {
+			t.Errorf("%s: periods %v, expected only 20231001-20231101", c.name, state.Periods)
+		}
+
+		if len(state.ReportLastModified) != 1 || !state.ReportLastModified["20231001-20231101"].Equal(time.Date(2023, 11, 5, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: last modified %v", c.name, state.ReportLastModified)
+		}
+
+		if _, ok := state.ReportAssemblyId["stray"]; ok {
+			t.Errorf("%s: assembly ID of invalid period was kept", c.name)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	cases := map[string]string{
+		"malformed":          `{"version":`,
+		"not an object":      `[]`,
+		"version type":       `{"version":5}`,
+		"version zero":       `{"version":"0"}`,
+		"version text":       `{"version":"five"}`,
+		"periods type":       `{"version":"2","BillingPeriod":{}}`,
+		"invalid period":     `{"version":"5","BillingPeriod":["2023"]}`,
+		"last modified type": `{"version":"5","reportLastModified":[]}`,
+	}
+
+	for name, data := range cases {
+		if _, _, err := Decode([]byte(data)); err == nil {
+			t.Errorf("%s: Decode() succeeded, expected error", name)
+		}
+	}
+}
+
+func TestDecodeNewerVersion(t *testing.T) {
+	newer := strconv.Itoa(len(migrations) + 2)
+	_, _, err := Decode([]byte(`{"version":"` + newer + `"}`))
+
+	var versionErr *VersionError
+	if !errors.As(err, &versionErr) || versionErr.Version != newer {
+		t.Fatalf("Decode() = %v, expected VersionError", err)
+	}
+}